@@ -0,0 +1,219 @@
+// Package adh implements the client side of TLS 1.0 to 1.2 with anonymous
+// Diffie-Hellman key exchange, the "ADH" cipher suites NRPE daemons use when
+// ssl_use_adh is enabled. crypto/tls deliberately doesn't implement them.
+//
+// Anonymous key exchange protects against passive eavesdroppers only: the
+// server is not authenticated, so an active attacker can intercept the
+// connection.
+package adh
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TLS versions.
+const (
+	VersionTLS10 = 0x0301
+	VersionTLS11 = 0x0302
+	VersionTLS12 = 0x0303
+)
+
+// Cipher suites implemented by this package.
+const (
+	TLS_DH_anon_WITH_AES_128_CBC_SHA uint16 = 0x0034
+	TLS_DH_anon_WITH_AES_256_CBC_SHA uint16 = 0x003a
+)
+
+// scsvRenegotiation signals support for secure renegotiation (RFC 5746).
+const scsvRenegotiation uint16 = 0x00ff
+
+type recordType uint8
+
+const (
+	recordTypeChangeCipherSpec recordType = 20
+	recordTypeAlert            recordType = 21
+	recordTypeHandshake        recordType = 22
+	recordTypeApplicationData  recordType = 23
+)
+
+const (
+	typeHelloRequest      uint8 = 0
+	typeClientHello       uint8 = 1
+	typeServerHello       uint8 = 2
+	typeCertificate       uint8 = 11
+	typeServerKeyExchange uint8 = 12
+	typeServerHelloDone   uint8 = 14
+	typeClientKeyExchange uint8 = 16
+	typeFinished          uint8 = 20
+)
+
+const (
+	// maxPlaintext is the largest record payload before encryption.
+	maxPlaintext = 16384
+	// maxCiphertext is the largest record payload after encryption.
+	maxCiphertext = maxPlaintext + 2048
+	// recordHeaderLen is the size of type, version and length.
+	recordHeaderLen = 5
+	// minDHBits is the smallest DH group accepted. NRPE 2.x ships with
+	// 512 bit parameters, so anything stricter would lock those out.
+	minDHBits = 512
+)
+
+// cipherSuite describes an ADH suite using AES-CBC and HMAC-SHA1.
+type cipherSuite struct {
+	id          uint16
+	keyLen      int
+	name        string
+	openSSLName string
+}
+
+// cipherSuites lists the implemented suites in order of preference.
+var cipherSuites = []*cipherSuite{
+	{TLS_DH_anon_WITH_AES_256_CBC_SHA, 32, "TLS_DH_anon_WITH_AES_256_CBC_SHA", "ADH-AES256-SHA"},
+	{TLS_DH_anon_WITH_AES_128_CBC_SHA, 16, "TLS_DH_anon_WITH_AES_128_CBC_SHA", "ADH-AES128-SHA"},
+}
+
+func cipherSuiteByID(id uint16) *cipherSuite {
+	for _, s := range cipherSuites {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// CipherSuiteByName returns the id of an implemented cipher suite given its
+// standard or OpenSSL name.
+func CipherSuiteByName(name string) (uint16, bool) {
+	for _, s := range cipherSuites {
+		if s.name == name || s.openSSLName == name {
+			return s.id, true
+		}
+	}
+	return 0, false
+}
+
+// CipherSuiteName returns the standard name of the cipher suite id.
+func CipherSuiteName(id uint16) string {
+	if s := cipherSuiteByID(id); s != nil {
+		return s.name
+	}
+	return fmt.Sprintf("0x%04X", id)
+}
+
+// VersionName returns the name of the TLS version, e.g. "TLS 1.2".
+func VersionName(version uint16) string {
+	switch version {
+	case VersionTLS10:
+		return "TLS 1.0"
+	case VersionTLS11:
+		return "TLS 1.1"
+	case VersionTLS12:
+		return "TLS 1.2"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// Config configures an ADH client. The zero value offers every implemented
+// cipher suite over TLS 1.0 to 1.2.
+type Config struct {
+	// Rand provides the entropy for nonces and the DH private key. If nil,
+	// crypto/rand is used.
+	Rand io.Reader
+	// MinVersion is the lowest acceptable TLS version, TLS 1.0 if zero.
+	MinVersion uint16
+	// MaxVersion is the highest TLS version offered, TLS 1.2 if zero.
+	MaxVersion uint16
+	// CipherSuites restricts the offered suites, all of them if empty.
+	CipherSuites []uint16
+}
+
+func (c *Config) rand() io.Reader {
+	if c == nil || c.Rand == nil {
+		return rand.Reader
+	}
+	return c.Rand
+}
+
+func (c *Config) minVersion() uint16 {
+	if c == nil || c.MinVersion == 0 {
+		return VersionTLS10
+	}
+	return c.MinVersion
+}
+
+func (c *Config) maxVersion() uint16 {
+	if c == nil || c.MaxVersion == 0 {
+		return VersionTLS12
+	}
+	return c.MaxVersion
+}
+
+func (c *Config) cipherSuites() []uint16 {
+	if c != nil && len(c.CipherSuites) > 0 {
+		return c.CipherSuites
+	}
+	ids := make([]uint16, len(cipherSuites))
+	for i, s := range cipherSuites {
+		ids[i] = s.id
+	}
+	return ids
+}
+
+// ConnectionState describes a completed handshake.
+type ConnectionState struct {
+	Version     uint16
+	CipherSuite uint16
+}
+
+type alert uint8
+
+const (
+	alertCloseNotify       alert = 0
+	alertUnexpectedMessage alert = 10
+	alertBadRecordMAC      alert = 20
+	alertHandshakeFailure  alert = 40
+	alertIllegalParameter  alert = 47
+	alertDecodeError       alert = 50
+	alertDecryptError      alert = 51
+	alertProtocolVersion   alert = 70
+	alertInternalError     alert = 80
+)
+
+var alertText = map[alert]string{
+	alertCloseNotify:       "close notify",
+	alertUnexpectedMessage: "unexpected message",
+	alertBadRecordMAC:      "bad record MAC",
+	alertHandshakeFailure:  "handshake failure",
+	alertIllegalParameter:  "illegal parameter",
+	alertDecodeError:       "error decoding message",
+	alertDecryptError:      "error decrypting message",
+	alertProtocolVersion:   "protocol version not supported",
+	alertInternalError:     "internal error",
+}
+
+func (a alert) String() string {
+	if s, ok := alertText[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("alert(%d)", uint8(a))
+}
+
+// ErrServerCertificate is returned by the handshake when the server sends a
+// certificate, meaning it doesn't offer anonymous DH but can be reached with
+// crypto/tls.
+var ErrServerCertificate = errors.New("adh: server sent a certificate, it is not configured for anonymous DH")
+
+// AlertError is a fatal alert sent by the server.
+type AlertError uint8
+
+// ErrHandshakeFailure is the alert servers without anonymous DH send when
+// they find no cipher suite in common.
+const ErrHandshakeFailure = AlertError(alertHandshakeFailure)
+
+func (e AlertError) Error() string {
+	return "adh: remote error: " + alert(e).String()
+}
@@ -0,0 +1,385 @@
+package adh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conn is a client side ADH TLS connection. It implements net.Conn.
+type Conn struct {
+	conn   net.Conn
+	config *Config
+
+	handshakeMutex    sync.Mutex
+	handshakeErr      error
+	handshakeComplete bool
+	vers              uint16
+	suite             *cipherSuite
+
+	inMutex sync.Mutex
+	in      halfConn
+	// hand holds handshake data not yet consumed.
+	hand []byte
+	// input holds application data not yet consumed.
+	input   []byte
+	readErr error
+
+	outMutex sync.Mutex
+	out      halfConn
+}
+
+// Client returns a new ADH TLS client connection over conn. The handshake
+// runs on the first Read or Write, or explicitly with Handshake.
+func Client(conn net.Conn, config *Config) *Conn {
+	return &Conn{conn: conn, config: config}
+}
+
+// Dial connects to addr and performs the ADH TLS handshake.
+func Dial(network, addr string, config *Config) (*Conn, error) {
+	raw, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := Client(raw, config)
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Handshake runs the client handshake if it hasn't run yet.
+func (c *Conn) Handshake() error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if c.handshakeComplete || c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+
+	c.inMutex.Lock()
+	c.outMutex.Lock()
+	c.handshakeErr = c.clientHandshake()
+	c.outMutex.Unlock()
+	c.inMutex.Unlock()
+
+	c.handshakeComplete = c.handshakeErr == nil
+	return c.handshakeErr
+}
+
+// ConnectionState returns the negotiated version and cipher suite.
+func (c *Conn) ConnectionState() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	state := ConnectionState{Version: c.vers}
+	if c.suite != nil {
+		state.CipherSuite = c.suite.id
+	}
+	return state
+}
+
+// Read reads application data from the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	c.inMutex.Lock()
+	defer c.inMutex.Unlock()
+	for len(c.input) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		typ, data, err := c.readRecord()
+		if err != nil {
+			c.readErr = err
+			return 0, err
+		}
+		switch typ {
+		case recordTypeApplicationData:
+			c.input = data
+		case recordTypeHandshake:
+			// Only a HelloRequest may arrive now. Renegotiation isn't
+			// supported, and ignoring the request is allowed.
+			if len(data) < 4 || data[0] != typeHelloRequest {
+				c.readErr = c.sendAlert(alertUnexpectedMessage)
+			}
+		default:
+			c.readErr = c.sendAlert(alertUnexpectedMessage)
+		}
+	}
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+// Write writes application data to the connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	n := 0
+	for len(b) > 0 {
+		m := len(b)
+		if m > maxPlaintext {
+			m = maxPlaintext
+		}
+		if err := c.writeRecord(recordTypeApplicationData, b[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// Close sends a close_notify alert if the handshake completed, and closes
+// the underlying connection.
+func (c *Conn) Close() error {
+	c.handshakeMutex.Lock()
+	complete := c.handshakeComplete
+	c.handshakeMutex.Unlock()
+	if complete {
+		c.outMutex.Lock()
+		c.writeRecord(recordTypeAlert, []byte{1, byte(alertCloseNotify)})
+		c.outMutex.Unlock()
+	}
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines of the underlying connection.
+func (c *Conn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// sendAlert sends a fatal alert and returns the error to report locally.
+func (c *Conn) sendAlert(a alert) error {
+	c.writeRecord(recordTypeAlert, []byte{2, byte(a)})
+	return fmt.Errorf("adh: local error: %s", a)
+}
+
+// readRecord reads the next record and returns its decrypted content.
+// Alerts are turned into errors, with close_notify reported as io.EOF.
+func (c *Conn) readRecord() (recordType, []byte, error) {
+	var header [recordHeaderLen]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, nil, err
+	}
+	typ := recordType(header[0])
+	vers := binary.BigEndian.Uint16(header[1:])
+	n := int(binary.BigEndian.Uint16(header[3:]))
+	if typ < recordTypeChangeCipherSpec || typ > recordTypeApplicationData {
+		return 0, nil, c.sendAlert(alertUnexpectedMessage)
+	}
+	if c.vers != 0 && vers != c.vers {
+		return 0, nil, c.sendAlert(alertProtocolVersion)
+	}
+	if n > maxCiphertext {
+		return 0, nil, c.sendAlert(alertDecodeError)
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	data, err := c.in.decrypt(typ, vers, payload)
+	if err != nil {
+		return 0, nil, c.sendAlert(alertBadRecordMAC)
+	}
+
+	if typ == recordTypeAlert {
+		if len(data) != 2 {
+			return 0, nil, c.sendAlert(alertDecodeError)
+		}
+		if alert(data[1]) == alertCloseNotify {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, AlertError(data[1])
+	}
+	return typ, data, nil
+}
+
+// writeRecord encrypts and writes a single record.
+func (c *Conn) writeRecord(typ recordType, data []byte) error {
+	vers := c.vers
+	if vers == 0 {
+		// Before the version is negotiated, records use TLS 1.0 for
+		// compatibility with old servers.
+		vers = VersionTLS10
+	}
+	payload, err := c.out.encrypt(typ, vers, data, c.config.rand())
+	if err != nil {
+		return err
+	}
+	record := make([]byte, recordHeaderLen, recordHeaderLen+len(payload))
+	record[0] = byte(typ)
+	binary.BigEndian.PutUint16(record[1:], vers)
+	binary.BigEndian.PutUint16(record[3:], uint16(len(payload)))
+	record = append(record, payload...)
+	_, err = c.conn.Write(record)
+	return err
+}
+
+var errBadRecord = errors.New("adh: invalid record")
+
+// halfConn holds the cipher state of one direction of the connection.
+type halfConn struct {
+	version uint16
+	block   cipher.Block
+	mac     hash.Hash
+	// iv is the CBC residue of the previous record before TLS 1.1, where
+	// IVs are implicit.
+	iv  []byte
+	seq [8]byte
+}
+
+// prepareCipher returns the cipher state for one direction of the suite.
+func prepareCipher(version uint16, key, macKey, iv []byte, newHash func() hash.Hash) (halfConn, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return halfConn{}, err
+	}
+	return halfConn{
+		version: version,
+		block:   block,
+		mac:     hmac.New(newHash, macKey),
+		iv:      append([]byte(nil), iv...),
+	}, nil
+}
+
+func (h *halfConn) incSeq() {
+	for i := 7; i >= 0; i-- {
+		h.seq[i]++
+		if h.seq[i] != 0 {
+			return
+		}
+	}
+}
+
+// computeMAC returns the record MAC, RFC 5246 section 6.2.3.1.
+func (h *halfConn) computeMAC(typ recordType, vers uint16, data []byte) []byte {
+	var header [13]byte
+	copy(header[:8], h.seq[:])
+	header[8] = byte(typ)
+	binary.BigEndian.PutUint16(header[9:], vers)
+	binary.BigEndian.PutUint16(header[11:], uint16(len(data)))
+	h.mac.Reset()
+	h.mac.Write(header[:])
+	h.mac.Write(data)
+	return h.mac.Sum(nil)
+}
+
+// encrypt MACs, pads and encrypts data. It returns data unchanged until
+// the ChangeCipherSpec.
+func (h *halfConn) encrypt(typ recordType, vers uint16, data []byte, rand io.Reader) ([]byte, error) {
+	if h.block == nil {
+		return data, nil
+	}
+	bs := h.block.BlockSize()
+	mac := h.computeMAC(typ, vers, data)
+	h.incSeq()
+
+	plain := make([]byte, 0, len(data)+len(mac)+bs)
+	plain = append(plain, data...)
+	plain = append(plain, mac...)
+	padLen := bs - len(plain)%bs
+	for i := 0; i < padLen; i++ {
+		plain = append(plain, byte(padLen-1))
+	}
+
+	var out []byte
+	iv := h.iv
+	if h.version >= VersionTLS11 {
+		// Explicit, random IV in front of each record.
+		out = make([]byte, bs+len(plain))
+		iv = out[:bs]
+		if _, err := io.ReadFull(rand, iv); err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(h.block, iv).CryptBlocks(out[bs:], plain)
+	} else {
+		out = make([]byte, len(plain))
+		cipher.NewCBCEncrypter(h.block, iv).CryptBlocks(out, plain)
+		h.iv = append(h.iv[:0], out[len(out)-bs:]...)
+	}
+	return out, nil
+}
+
+// decrypt decrypts payload and checks its padding and MAC. It returns
+// payload unchanged until the ChangeCipherSpec.
+func (h *halfConn) decrypt(typ recordType, vers uint16, payload []byte) ([]byte, error) {
+	if h.block == nil {
+		return payload, nil
+	}
+	bs := h.block.BlockSize()
+	macSize := h.mac.Size()
+
+	iv := h.iv
+	if h.version >= VersionTLS11 {
+		if len(payload) < bs {
+			return nil, errBadRecord
+		}
+		iv = payload[:bs]
+		payload = payload[bs:]
+	}
+	if len(payload)%bs != 0 || len(payload) < macSize+1 {
+		return nil, errBadRecord
+	}
+	var nextIV []byte
+	if h.version < VersionTLS11 {
+		nextIV = append([]byte(nil), payload[len(payload)-bs:]...)
+	}
+	plain := make([]byte, len(payload))
+	cipher.NewCBCDecrypter(h.block, iv).CryptBlocks(plain, payload)
+	if nextIV != nil {
+		h.iv = nextIV
+	}
+
+	padLen := int(plain[len(plain)-1])
+	if padLen+1+macSize > len(plain) {
+		return nil, errBadRecord
+	}
+	good := 1
+	for _, b := range plain[len(plain)-1-padLen:] {
+		good &= subtle.ConstantTimeByteEq(b, byte(padLen))
+	}
+	data := plain[:len(plain)-1-padLen-macSize]
+	mac := plain[len(data) : len(data)+macSize]
+	expected := h.computeMAC(typ, vers, data)
+	h.incSeq()
+	if good != 1 || !hmac.Equal(mac, expected) {
+		return nil, errBadRecord
+	}
+	return data, nil
+}
@@ -0,0 +1,165 @@
+package adh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+)
+
+// cipherPair returns the sending and receiving state of one direction.
+func cipherPair(t *testing.T, version uint16, key, macKey, iv []byte) (halfConn, halfConn) {
+	t.Helper()
+	out, err := prepareCipher(version, key, macKey, iv, sha1.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := prepareCipher(version, key, macKey, iv, sha1.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, in
+}
+
+// openRecord decrypts a record with plain AES-CBC and checks its padding and
+// MAC as laid out in RFC 5246 section 6.2.3.2, independently of halfConn.
+func openRecord(t *testing.T, version uint16, key, macKey, iv []byte, seq uint64, typ recordType, payload []byte) []byte {
+	t.Helper()
+	block, _ := aes.NewCipher(key)
+	if version >= VersionTLS11 {
+		iv, payload = payload[:aes.BlockSize], payload[aes.BlockSize:]
+	}
+	if len(payload)%aes.BlockSize != 0 {
+		t.Fatalf("ciphertext of %d bytes is not whole blocks", len(payload))
+	}
+	plain := make([]byte, len(payload))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, payload)
+
+	padLen := int(plain[len(plain)-1])
+	for _, b := range plain[len(plain)-1-padLen:] {
+		if int(b) != padLen {
+			t.Fatalf("bad padding % x", plain[len(plain)-1-padLen:])
+		}
+	}
+	plain = plain[:len(plain)-1-padLen]
+	data, mac := plain[:len(plain)-sha1.Size], plain[len(plain)-sha1.Size:]
+
+	h := hmac.New(sha1.New, macKey)
+	var header [13]byte
+	binary.BigEndian.PutUint64(header[:], seq)
+	header[8] = byte(typ)
+	binary.BigEndian.PutUint16(header[9:], version)
+	binary.BigEndian.PutUint16(header[11:], uint16(len(data)))
+	h.Write(header[:])
+	h.Write(data)
+	if !hmac.Equal(mac, h.Sum(nil)) {
+		t.Fatalf("bad MAC for record %d", seq)
+	}
+	return data
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 32)
+	macKey := bytes.Repeat([]byte{0x22}, sha1.Size)
+	iv := bytes.Repeat([]byte{0x33}, aes.BlockSize)
+	messages := [][]byte{
+		[]byte("check_load"),
+		{},
+		bytes.Repeat([]byte("x"), aes.BlockSize*3),
+		bytes.Repeat([]byte("y"), maxPlaintext),
+	}
+
+	for _, version := range []uint16{VersionTLS10, VersionTLS11, VersionTLS12} {
+		t.Run(VersionName(version), func(t *testing.T) {
+			out, in := cipherPair(t, version, key, macKey, iv)
+			// The implicit IV of TLS 1.0 chains from the previous record.
+			prevIV := iv
+			for seq, msg := range messages {
+				payload, err := out.encrypt(recordTypeApplicationData, version, msg, rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(payload, []byte("check_load")) {
+					t.Fatal("record is not encrypted")
+				}
+				got := openRecord(t, version, key, macKey, prevIV, uint64(seq), recordTypeApplicationData, payload)
+				if !bytes.Equal(got, msg) {
+					t.Fatalf("record %d decrypted independently to %q", seq, got)
+				}
+				if version < VersionTLS11 {
+					prevIV = payload[len(payload)-aes.BlockSize:]
+				}
+
+				data, err := in.decrypt(recordTypeApplicationData, version, payload)
+				if err != nil {
+					t.Fatalf("decrypting record %d: %s", seq, err)
+				}
+				if !bytes.Equal(data, msg) {
+					t.Fatalf("record %d round tripped to %q, want %q", seq, data, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{0x44}, 16)
+	macKey := bytes.Repeat([]byte{0x55}, sha1.Size)
+	iv := bytes.Repeat([]byte{0x66}, aes.BlockSize)
+	msg := []byte("OK - load average: 0.50, 0.40, 0.30")
+
+	for _, version := range []uint16{VersionTLS10, VersionTLS12} {
+		for _, tc := range []struct {
+			name   string
+			tamper func(payload []byte) []byte
+			typ    recordType
+			replay bool
+		}{
+			{name: "intact", tamper: func(p []byte) []byte { return p }, typ: recordTypeApplicationData},
+			{name: "flipped bit", tamper: func(p []byte) []byte { p[len(p)/2] ^= 1; return p }, typ: recordTypeApplicationData},
+			{name: "flipped last byte", tamper: func(p []byte) []byte { p[len(p)-1] ^= 0x80; return p }, typ: recordTypeApplicationData},
+			{name: "truncated", tamper: func(p []byte) []byte { return p[:len(p)-aes.BlockSize] }, typ: recordTypeApplicationData},
+			{name: "partial block", tamper: func(p []byte) []byte { return p[:len(p)-1] }, typ: recordTypeApplicationData},
+			{name: "other type", tamper: func(p []byte) []byte { return p }, typ: recordTypeHandshake},
+			{name: "replayed", tamper: func(p []byte) []byte { return p }, typ: recordTypeApplicationData, replay: true},
+		} {
+			t.Run(VersionName(version)+" "+tc.name, func(t *testing.T) {
+				out, in := cipherPair(t, version, key, macKey, iv)
+				payload, err := out.encrypt(recordTypeApplicationData, version, msg, rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.replay {
+					if _, err := in.decrypt(recordTypeApplicationData, version, append([]byte(nil), payload...)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				_, err = in.decrypt(tc.typ, version, tc.tamper(payload))
+				if tc.name == "intact" {
+					if err != nil {
+						t.Errorf("intact record rejected: %s", err)
+					}
+				} else if err != errBadRecord {
+					t.Errorf("decrypt returned %v, want %v", err, errBadRecord)
+				}
+			})
+		}
+	}
+}
+
+func TestRecordBeforeChangeCipherSpec(t *testing.T) {
+	var h halfConn
+	msg := []byte("hello")
+	out, err := h.encrypt(recordTypeHandshake, VersionTLS10, msg, rand.Reader)
+	if err != nil || !bytes.Equal(out, msg) {
+		t.Errorf("encrypt without keys returned %q, %v", out, err)
+	}
+	in, err := h.decrypt(recordTypeHandshake, VersionTLS10, msg)
+	if err != nil || !bytes.Equal(in, msg) {
+		t.Errorf("decrypt without keys returned %q, %v", in, err)
+	}
+}
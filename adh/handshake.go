@@ -0,0 +1,262 @@
+package adh
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// clientHandshake performs an anonymous DH handshake, RFC 5246 section 7.3,
+// without session resumption or extensions.
+func (c *Conn) clientHandshake() error {
+	rand := c.config.rand()
+	minVersion, maxVersion := c.config.minVersion(), c.config.maxVersion()
+	var transcript []byte
+
+	clientRandom := make([]byte, 32)
+	if _, err := io.ReadFull(rand, clientRandom); err != nil {
+		return err
+	}
+	hello := c.marshalClientHello(maxVersion, clientRandom)
+	transcript = append(transcript, hello...)
+	if err := c.writeRecord(recordTypeHandshake, hello); err != nil {
+		return err
+	}
+
+	// ServerHello
+	msg, err := c.readHandshake(typeServerHello)
+	if err != nil {
+		return err
+	}
+	transcript = append(transcript, msg...)
+	serverRandom, err := c.processServerHello(msg[4:], minVersion, maxVersion)
+	if err != nil {
+		return err
+	}
+
+	// ServerKeyExchange carrying the server's DH parameters and public value.
+	msg, err = c.readHandshake(typeServerKeyExchange)
+	if err != nil {
+		return err
+	}
+	transcript = append(transcript, msg...)
+	p, g, serverPublic, err := parseServerKeyExchange(msg[4:])
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.sendAlert(alertIllegalParameter), err)
+	}
+
+	msg, err = c.readHandshake(typeServerHelloDone)
+	if err != nil {
+		return err
+	}
+	transcript = append(transcript, msg...)
+
+	// ClientKeyExchange with our DH public value.
+	max := new(big.Int).Sub(p, big.NewInt(2))
+	x, err := randInt(rand, max)
+	if err != nil {
+		return err
+	}
+	x.Add(x, big.NewInt(1))
+	clientPublic := new(big.Int).Exp(g, x, p)
+	preMaster := new(big.Int).Exp(serverPublic, x, p).Bytes()
+
+	yc := clientPublic.Bytes()
+	body := make([]byte, 2+len(yc))
+	binary.BigEndian.PutUint16(body, uint16(len(yc)))
+	copy(body[2:], yc)
+	msg = marshalHandshake(typeClientKeyExchange, body)
+	transcript = append(transcript, msg...)
+	if err := c.writeRecord(recordTypeHandshake, msg); err != nil {
+		return err
+	}
+
+	// Derive keys and switch our side to them.
+	master := masterFromPreMaster(c.vers, preMaster, clientRandom, serverRandom)
+	macLen, ivLen := sha1.Size, 16
+	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV :=
+		keysFromMaster(c.vers, master, clientRandom, serverRandom, macLen, c.suite.keyLen, ivLen)
+	out, err := prepareCipher(c.vers, clientKey, clientMAC, clientIV, sha1.New)
+	if err != nil {
+		return err
+	}
+	in, err := prepareCipher(c.vers, serverKey, serverMAC, serverIV, sha1.New)
+	if err != nil {
+		return err
+	}
+
+	if err := c.writeRecord(recordTypeChangeCipherSpec, []byte{1}); err != nil {
+		return err
+	}
+	c.out = out
+	msg = marshalHandshake(typeFinished, finishedSum(c.vers, master, clientFinishedLabel, transcript))
+	transcript = append(transcript, msg...)
+	if err := c.writeRecord(recordTypeHandshake, msg); err != nil {
+		return err
+	}
+
+	// The server switches to its keys and proves it derived the same ones.
+	typ, data, err := c.readRecord()
+	if err != nil {
+		return err
+	}
+	if typ != recordTypeChangeCipherSpec || len(data) != 1 || data[0] != 1 || len(c.hand) > 0 {
+		return c.sendAlert(alertUnexpectedMessage)
+	}
+	c.in = in
+	msg, err = c.readHandshake(typeFinished)
+	if err != nil {
+		return err
+	}
+	expected := finishedSum(c.vers, master, serverFinishedLabel, transcript)
+	if !hmac.Equal(msg[4:], expected) {
+		return c.sendAlert(alertHandshakeFailure)
+	}
+	return nil
+}
+
+func marshalHandshake(typ uint8, body []byte) []byte {
+	msg := make([]byte, 4+len(body))
+	msg[0] = typ
+	msg[1] = byte(len(body) >> 16)
+	msg[2] = byte(len(body) >> 8)
+	msg[3] = byte(len(body))
+	copy(msg[4:], body)
+	return msg
+}
+
+func (c *Conn) marshalClientHello(version uint16, random []byte) []byte {
+	suites := append(append([]uint16(nil), c.config.cipherSuites()...), scsvRenegotiation)
+
+	body := make([]byte, 0, 2+32+1+2+2*len(suites)+2)
+	body = append(body, byte(version>>8), byte(version))
+	body = append(body, random...)
+	// No session ID.
+	body = append(body, 0)
+	n := 2 * len(suites)
+	body = append(body, byte(n>>8), byte(n))
+	for _, s := range suites {
+		body = append(body, byte(s>>8), byte(s))
+	}
+	// Only the null compression method.
+	body = append(body, 1, 0)
+	return marshalHandshake(typeClientHello, body)
+}
+
+// processServerHello checks the version and cipher suite the server chose,
+// and returns the server random.
+func (c *Conn) processServerHello(body []byte, minVersion, maxVersion uint16) ([]byte, error) {
+	if len(body) < 2+32+1 {
+		return nil, c.sendAlert(alertDecodeError)
+	}
+	vers := binary.BigEndian.Uint16(body)
+	random := body[2:34]
+	sessionIDLen := int(body[34])
+	body = body[35:]
+	if len(body) < sessionIDLen+3 {
+		return nil, c.sendAlert(alertDecodeError)
+	}
+	body = body[sessionIDLen:]
+	suiteID := binary.BigEndian.Uint16(body)
+	compression := body[2]
+
+	if vers < minVersion || vers > maxVersion {
+		c.sendAlert(alertProtocolVersion)
+		return nil, fmt.Errorf("adh: server selected unsupported version %s", VersionName(vers))
+	}
+	c.vers = vers
+
+	offered := false
+	for _, id := range c.config.cipherSuites() {
+		offered = offered || id == suiteID
+	}
+	suite := cipherSuiteByID(suiteID)
+	if !offered || suite == nil {
+		c.sendAlert(alertHandshakeFailure)
+		return nil, fmt.Errorf("adh: server selected unoffered cipher suite %s", CipherSuiteName(suiteID))
+	}
+	if compression != 0 {
+		return nil, c.sendAlert(alertIllegalParameter)
+	}
+	c.suite = suite
+	return random, nil
+}
+
+// parseServerKeyExchange parses ServerDHParams, which anonymous suites send
+// without a signature.
+func parseServerKeyExchange(body []byte) (p, g, ys *big.Int, err error) {
+	var params [3]*big.Int
+	for i := range params {
+		if len(body) < 2 {
+			return nil, nil, nil, errors.New("short ServerKeyExchange")
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		if n == 0 || len(body) < 2+n {
+			return nil, nil, nil, errors.New("short ServerKeyExchange")
+		}
+		params[i] = new(big.Int).SetBytes(body[2 : 2+n])
+		body = body[2+n:]
+	}
+	p, g, ys = params[0], params[1], params[2]
+
+	one := big.NewInt(1)
+	pMinusOne := new(big.Int).Sub(p, one)
+	if p.BitLen() < minDHBits || p.Bit(0) == 0 {
+		return nil, nil, nil, fmt.Errorf("insecure DH group of %d bits", p.BitLen())
+	}
+	if g.Cmp(one) <= 0 || g.Cmp(pMinusOne) >= 0 {
+		return nil, nil, nil, errors.New("invalid DH generator")
+	}
+	if ys.Cmp(one) <= 0 || ys.Cmp(pMinusOne) >= 0 {
+		return nil, nil, nil, errors.New("invalid DH public value")
+	}
+	return p, g, ys, nil
+}
+
+// readHandshake returns the next handshake message, including its header,
+// which must be of type want.
+func (c *Conn) readHandshake(want uint8) ([]byte, error) {
+	for {
+		if len(c.hand) >= 4 {
+			n := int(c.hand[1])<<16 | int(c.hand[2])<<8 | int(c.hand[3])
+			if n > maxPlaintext {
+				return nil, c.sendAlert(alertDecodeError)
+			}
+			if len(c.hand) >= 4+n {
+				msg := c.hand[:4+n]
+				c.hand = c.hand[4+n:]
+				if msg[0] == typeCertificate {
+					c.sendAlert(alertHandshakeFailure)
+					return nil, ErrServerCertificate
+				}
+				if msg[0] != want {
+					return nil, c.sendAlert(alertUnexpectedMessage)
+				}
+				return msg, nil
+			}
+		}
+
+		typ, data, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if typ != recordTypeHandshake {
+			return nil, c.sendAlert(alertUnexpectedMessage)
+		}
+		c.hand = append(c.hand, data...)
+	}
+}
+
+// randInt returns a uniform random value in [0, max).
+func randInt(rand io.Reader, max *big.Int) (*big.Int, error) {
+	b := make([]byte, (max.BitLen()+7)/8+8)
+	if _, err := io.ReadFull(rand, b); err != nil {
+		return nil, err
+	}
+	// The extra 64 bits make the modulo bias negligible.
+	return new(big.Int).Mod(new(big.Int).SetBytes(b), max), nil
+}
@@ -0,0 +1,294 @@
+package adh
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal ADH TLS server that echoes application data.
+type fakeServer struct {
+	version uint16
+	suite   uint16
+	p, g    *big.Int
+	// badFinished makes the server send a wrong Finished message.
+	badFinished bool
+	// certificate makes the server send a Certificate message, as
+	// daemons without ADH do.
+	certificate bool
+
+	conn       net.Conn
+	in, out    halfConn
+	transcript []byte
+}
+
+func (s *fakeServer) readRecord() (recordType, []byte, error) {
+	var header [recordHeaderLen]byte
+	if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		return 0, nil, err
+	}
+	typ := recordType(header[0])
+	data, err := s.in.decrypt(typ, binary.BigEndian.Uint16(header[1:]), payload)
+	return typ, data, err
+}
+
+func (s *fakeServer) writeRecord(typ recordType, data []byte) error {
+	payload, err := s.out.encrypt(typ, s.version, data, rand.Reader)
+	if err != nil {
+		return err
+	}
+	header := []byte{byte(typ), byte(s.version >> 8), byte(s.version), byte(len(payload) >> 8), byte(len(payload))}
+	_, err = s.conn.Write(append(header, payload...))
+	return err
+}
+
+// readHandshake reads a handshake message of type want, which the client
+// sends one per record.
+func (s *fakeServer) readHandshake(want uint8) ([]byte, error) {
+	typ, msg, err := s.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	if typ != recordTypeHandshake || len(msg) < 4 || msg[0] != want {
+		return nil, fmt.Errorf("expected handshake message %d, got record %d % x", want, typ, msg)
+	}
+	s.transcript = append(s.transcript, msg...)
+	return msg[4:], nil
+}
+
+func (s *fakeServer) serve(conn net.Conn) error {
+	s.conn = conn
+	defer conn.Close()
+
+	hello, err := s.readHandshake(typeClientHello)
+	if err != nil {
+		return err
+	}
+	clientRandom := hello[2:34]
+
+	serverRandom := make([]byte, 32)
+	rand.Read(serverRandom)
+	body := append([]byte{byte(s.version >> 8), byte(s.version)}, serverRandom...)
+	body = append(body, 0, byte(s.suite>>8), byte(s.suite), 0)
+	flight := marshalHandshake(typeServerHello, body)
+	if s.certificate {
+		flight = append(flight, marshalHandshake(typeCertificate, []byte{0, 0, 0})...)
+	}
+	y, _ := rand.Int(rand.Reader, new(big.Int).Sub(s.p, big.NewInt(2)))
+	y.Add(y, big.NewInt(1))
+	var params []byte
+	for _, n := range []*big.Int{s.p, s.g, new(big.Int).Exp(s.g, y, s.p)} {
+		b := n.Bytes()
+		params = append(params, byte(len(b)>>8), byte(len(b)))
+		params = append(params, b...)
+	}
+	flight = append(flight, marshalHandshake(typeServerKeyExchange, params)...)
+	flight = append(flight, marshalHandshake(typeServerHelloDone, nil)...)
+	// The whole flight goes in one record, which the client must split.
+	s.transcript = append(s.transcript, flight...)
+	if err := s.writeRecord(recordTypeHandshake, flight); err != nil {
+		return err
+	}
+
+	cke, err := s.readHandshake(typeClientKeyExchange)
+	if err != nil {
+		return err
+	}
+	clientPublic := new(big.Int).SetBytes(cke[2:])
+	preMaster := new(big.Int).Exp(clientPublic, y, s.p).Bytes()
+	master := masterFromPreMaster(s.version, preMaster, clientRandom, serverRandom)
+	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV :=
+		keysFromMaster(s.version, master, clientRandom, serverRandom, sha1.Size, cipherSuiteByID(s.suite).keyLen, 16)
+
+	typ, data, err := s.readRecord()
+	if err != nil {
+		return err
+	}
+	if typ != recordTypeChangeCipherSpec || len(data) != 1 {
+		return fmt.Errorf("expected ChangeCipherSpec, got record %d", typ)
+	}
+	if s.in, err = prepareCipher(s.version, clientKey, clientMAC, clientIV, sha1.New); err != nil {
+		return err
+	}
+	expected := finishedSum(s.version, master, clientFinishedLabel, s.transcript)
+	finished, err := s.readHandshake(typeFinished)
+	if err != nil {
+		return err
+	}
+	if string(finished) != string(expected) {
+		return errors.New("client Finished does not match")
+	}
+
+	if err := s.writeRecord(recordTypeChangeCipherSpec, []byte{1}); err != nil {
+		return err
+	}
+	if s.out, err = prepareCipher(s.version, serverKey, serverMAC, serverIV, sha1.New); err != nil {
+		return err
+	}
+	verify := finishedSum(s.version, master, serverFinishedLabel, s.transcript)
+	if s.badFinished {
+		verify[0] ^= 1
+	}
+	if err := s.writeRecord(recordTypeHandshake, marshalHandshake(typeFinished, verify)); err != nil {
+		return err
+	}
+
+	for {
+		typ, data, err := s.readRecord()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case recordTypeApplicationData:
+			if err := s.writeRecord(recordTypeApplicationData, data); err != nil {
+				return err
+			}
+		case recordTypeAlert:
+			return nil
+		default:
+			return fmt.Errorf("unexpected record %d", typ)
+		}
+	}
+}
+
+// startServer serves s on a local port, and returns its address and the
+// error it ended with.
+func startServer(t *testing.T, s *fakeServer) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		errc <- s.serve(conn)
+	}()
+	return l.Addr().String(), errc
+}
+
+func testPrime(t *testing.T, bits int) *big.Int {
+	t.Helper()
+	p, err := rand.Prime(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHandshake(t *testing.T) {
+	p := testPrime(t, 1024)
+	for _, tc := range []struct {
+		version uint16
+		suite   uint16
+	}{
+		{VersionTLS10, TLS_DH_anon_WITH_AES_128_CBC_SHA},
+		{VersionTLS10, TLS_DH_anon_WITH_AES_256_CBC_SHA},
+		{VersionTLS11, TLS_DH_anon_WITH_AES_256_CBC_SHA},
+		{VersionTLS12, TLS_DH_anon_WITH_AES_128_CBC_SHA},
+		{VersionTLS12, TLS_DH_anon_WITH_AES_256_CBC_SHA},
+	} {
+		t.Run(VersionName(tc.version)+" "+CipherSuiteName(tc.suite), func(t *testing.T) {
+			addr, errc := startServer(t, &fakeServer{version: tc.version, suite: tc.suite, p: p, g: big.NewInt(2)})
+			conn, err := Dial("tcp", addr, nil)
+			if err != nil {
+				t.Fatalf("handshake: %s", err)
+			}
+			state := conn.ConnectionState()
+			if state.Version != tc.version || state.CipherSuite != tc.suite {
+				t.Errorf("negotiated %s %s", VersionName(state.Version), CipherSuiteName(state.CipherSuite))
+			}
+
+			// Larger than a record, so it is split and reassembled.
+			msg := []byte(strings.Repeat("check_load!1!2!3 ", 2000))
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatalf("write: %s", err)
+			}
+			echo := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, echo); err != nil {
+				t.Fatalf("read: %s", err)
+			}
+			if string(echo) != string(msg) {
+				t.Error("echoed data differs")
+			}
+			conn.Close()
+			if err := <-errc; err != nil {
+				t.Errorf("server: %s", err)
+			}
+		})
+	}
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	p := testPrime(t, 1024)
+	for _, tc := range []struct {
+		name   string
+		server *fakeServer
+		config *Config
+		err    string
+	}{
+		{
+			name:   "small DH group",
+			server: &fakeServer{version: VersionTLS12, suite: TLS_DH_anon_WITH_AES_128_CBC_SHA, p: testPrime(t, 256), g: big.NewInt(2)},
+			err:    "adh: local error: illegal parameter: insecure DH group of 256 bits",
+		},
+		{
+			name:   "bad generator",
+			server: &fakeServer{version: VersionTLS12, suite: TLS_DH_anon_WITH_AES_128_CBC_SHA, p: p, g: big.NewInt(1)},
+			err:    "adh: local error: illegal parameter: invalid DH generator",
+		},
+		{
+			name:   "version below minimum",
+			server: &fakeServer{version: VersionTLS10, suite: TLS_DH_anon_WITH_AES_128_CBC_SHA, p: p, g: big.NewInt(2)},
+			config: &Config{MinVersion: VersionTLS12},
+			err:    "adh: server selected unsupported version TLS 1.0",
+		},
+		{
+			name:   "unoffered suite",
+			server: &fakeServer{version: VersionTLS12, suite: TLS_DH_anon_WITH_AES_256_CBC_SHA, p: p, g: big.NewInt(2)},
+			config: &Config{CipherSuites: []uint16{TLS_DH_anon_WITH_AES_128_CBC_SHA}},
+			err:    "adh: server selected unoffered cipher suite TLS_DH_anon_WITH_AES_256_CBC_SHA",
+		},
+		{
+			name:   "certificate",
+			server: &fakeServer{version: VersionTLS12, suite: TLS_DH_anon_WITH_AES_128_CBC_SHA, p: p, g: big.NewInt(2), certificate: true},
+			err:    "adh: server sent a certificate, it is not configured for anonymous DH",
+		},
+		{
+			name:   "bad Finished",
+			server: &fakeServer{version: VersionTLS11, suite: TLS_DH_anon_WITH_AES_128_CBC_SHA, p: p, g: big.NewInt(2), badFinished: true},
+			err:    "adh: local error: handshake failure",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, errc := startServer(t, tc.server)
+			conn, err := Dial("tcp", addr, tc.config)
+			if err == nil {
+				conn.Close()
+				t.Fatal("handshake succeeded")
+			}
+			if err.Error() != tc.err {
+				t.Errorf("handshake failed with %q, want %q", err, tc.err)
+			}
+			<-errc
+		})
+	}
+}
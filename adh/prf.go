@@ -0,0 +1,116 @@
+package adh
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+)
+
+const (
+	masterSecretLength   = 48
+	finishedVerifyLength = 12
+)
+
+var (
+	masterSecretLabel   = []byte("master secret")
+	keyExpansionLabel   = []byte("key expansion")
+	clientFinishedLabel = []byte("client finished")
+	serverFinishedLabel = []byte("server finished")
+)
+
+// pHash implements P_hash from RFC 4346, section 5.
+func pHash(result, secret, seed []byte, h func() hash.Hash) {
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+
+	for j := 0; j < len(result); {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		j += copy(result[j:], mac.Sum(nil))
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+}
+
+// prf10 is the PRF of TLS 1.0 and 1.1, RFC 4346 section 5.
+func prf10(result, secret, label, seed []byte) {
+	labelAndSeed := append(append([]byte(nil), label...), seed...)
+	s1 := secret[:(len(secret)+1)/2]
+	s2 := secret[len(secret)/2:]
+
+	pHash(result, s1, labelAndSeed, md5.New)
+	result2 := make([]byte, len(result))
+	pHash(result2, s2, labelAndSeed, sha1.New)
+	for i, b := range result2 {
+		result[i] ^= b
+	}
+}
+
+// prf12 is the PRF of TLS 1.2 for the suites in this package, RFC 5246
+// section 5.
+func prf12(result, secret, label, seed []byte) {
+	labelAndSeed := append(append([]byte(nil), label...), seed...)
+	pHash(result, secret, labelAndSeed, sha256.New)
+}
+
+func prfForVersion(version uint16) func(result, secret, label, seed []byte) {
+	if version >= VersionTLS12 {
+		return prf12
+	}
+	return prf10
+}
+
+// transcriptHash hashes the handshake messages for the Finished messages.
+func transcriptHash(version uint16, transcript []byte) []byte {
+	if version >= VersionTLS12 {
+		sum := sha256.Sum256(transcript)
+		return sum[:]
+	}
+	md5sum := md5.Sum(transcript)
+	sha1sum := sha1.Sum(transcript)
+	return append(md5sum[:], sha1sum[:]...)
+}
+
+// masterFromPreMaster derives the master secret, RFC 5246 section 8.1.
+func masterFromPreMaster(version uint16, preMaster, clientRandom, serverRandom []byte) []byte {
+	seed := append(append([]byte(nil), clientRandom...), serverRandom...)
+	master := make([]byte, masterSecretLength)
+	prfForVersion(version)(master, preMaster, masterSecretLabel, seed)
+	return master
+}
+
+// keysFromMaster expands the master secret into the MAC keys, cipher keys
+// and initial IVs of both directions, RFC 5246 section 6.3. The IVs are
+// only used before TLS 1.1, where they are implicit.
+func keysFromMaster(version uint16, master, clientRandom, serverRandom []byte, macLen, keyLen, ivLen int) (clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV []byte) {
+	seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+	n := 2*macLen + 2*keyLen + 2*ivLen
+	block := make([]byte, n)
+	prfForVersion(version)(block, master, keyExpansionLabel, seed)
+
+	next := func(l int) []byte {
+		b := block[:l]
+		block = block[l:]
+		return b
+	}
+	clientMAC = next(macLen)
+	serverMAC = next(macLen)
+	clientKey = next(keyLen)
+	serverKey = next(keyLen)
+	clientIV = next(ivLen)
+	serverIV = next(ivLen)
+	return
+}
+
+// finishedSum computes the verify_data of a Finished message.
+func finishedSum(version uint16, master, label, transcript []byte) []byte {
+	out := make([]byte, finishedVerifyLength)
+	prfForVersion(version)(out, master, label, transcriptHash(version, transcript))
+	return out
+}
@@ -0,0 +1,95 @@
+package adh
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Known answers computed with OpenSSL's TLS1-PRF, using MD5-SHA1 for TLS
+// 1.0 and SHA256 for TLS 1.2.
+func TestPRF(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		prf    func(result, secret, label, seed []byte)
+		secret string
+		want   string
+	}{
+		{
+			name:   "TLS 1.2",
+			prf:    prf12,
+			secret: "9bbe436ba940f017b17652849a71db35",
+			want: "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a6b301791e90d35c9c9a46b4e14baf9af" +
+				"0fa022f7077def17abfd3797c0564bab4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff70187347b66",
+		},
+		{
+			name:   "TLS 1.0",
+			prf:    prf10,
+			secret: "9bbe436ba940f017b17652849a71db35",
+			want: "661740e6f98bc901efd2738502a71c03f76dd2f86298549b1148eff06714cf0f6b7c532cd8c69f1530e0bb680eec34c4" +
+				"95fa75a8bfcc9c335484c0d3d194ab6e32975903c50ebcdbe9d67c0591bdbd80dddcc36d33ccd58adf96caae173f48dc40f983e2",
+		},
+		{
+			// The two halves of an odd length secret share its middle byte.
+			name:   "TLS 1.0 odd secret",
+			prf:    prf10,
+			secret: "9bbe436ba940f017b17652849a71db35ab",
+			want:   "c55cce910d01afe4fce09b84d3e47936666d769a2426ac9c83d72566c314df98f4d8b00455413a99157901aa87dd4c7d",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := decodeHex(t, tc.want)
+			got := make([]byte, len(want))
+			tc.prf(got, decodeHex(t, tc.secret), []byte("test label"), decodeHex(t, "a0ba9f936cda311827a6f796ffd5198c"))
+			if !bytes.Equal(got, want) {
+				t.Errorf("PRF output\n got %x\nwant %x", got, want)
+			}
+		})
+	}
+}
+
+func TestPRFForVersion(t *testing.T) {
+	secret, seed := []byte("secret"), []byte("seed")
+	for _, tc := range []struct {
+		version uint16
+		prf     func(result, secret, label, seed []byte)
+	}{
+		{VersionTLS10, prf10},
+		{VersionTLS11, prf10},
+		{VersionTLS12, prf12},
+	} {
+		got, want := make([]byte, 32), make([]byte, 32)
+		prfForVersion(tc.version)(got, secret, masterSecretLabel, seed)
+		tc.prf(want, secret, masterSecretLabel, seed)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s uses the wrong PRF", VersionName(tc.version))
+		}
+	}
+}
+
+func TestKeysFromMaster(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, masterSecretLength)
+	clientRandom := bytes.Repeat([]byte{2}, 32)
+	serverRandom := bytes.Repeat([]byte{3}, 32)
+	block := make([]byte, 2*20+2*32+2*16)
+	prf12(block, master, keyExpansionLabel, append(append([]byte(nil), serverRandom...), clientRandom...))
+
+	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV :=
+		keysFromMaster(VersionTLS12, master, clientRandom, serverRandom, 20, 32, 16)
+	got := bytes.Join([][]byte{clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV}, nil)
+	if !bytes.Equal(got, block) {
+		t.Errorf("keys are not the key block in order\n got %x\nwant %x", got, block)
+	}
+	if len(clientMAC) != 20 || len(serverKey) != 32 || len(serverIV) != 16 {
+		t.Errorf("key lengths are %d, %d and %d", len(clientMAC), len(serverKey), len(serverIV))
+	}
+}
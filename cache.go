@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// resultCache holds command results for modules with a cache TTL.
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	result  CommandResult
+	expires time.Time
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{entries: make(map[string]cacheEntry)}
+}
+
+// get returns the result cached under key, if it hasn't expired.
+func (c *resultCache) get(key string) (CommandResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return CommandResult{}, false
+	}
+	return e.result, true
+}
+
+// put caches result under key for ttl, dropping expired entries.
+func (c *resultCache) put(key string, result CommandResult, ttl time.Duration) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{result: result, expires: now.Add(ttl)}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// CommandRule allows a command, optionally with arguments.
+type CommandRule struct {
+	Name string `yaml:"name"`
+	// Args is a regular expression every argument must match in full. The
+	// command can't be given arguments if it is unset.
+	Args string `yaml:"args,omitempty"`
+
+	args *regexp.Regexp
+}
+
+// CommandAllowlist is a list of allowed commands. An empty list allows any
+// command.
+type CommandAllowlist []CommandRule
+
+// init validates the rules and compiles their argument expressions.
+func (l CommandAllowlist) init() error {
+	for i, rule := range l {
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d has no command name", i+1)
+		}
+		if rule.Args == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + rule.Args + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid args expression for command %q: %s", rule.Name, err)
+		}
+		l[i].args = re
+	}
+	return nil
+}
+
+// check returns an error unless a rule allows cmd with args.
+func (l CommandAllowlist) check(cmd string, args []string) error {
+	if len(l) == 0 {
+		return nil
+	}
+	found := false
+	for _, rule := range l {
+		if rule.Name != cmd {
+			continue
+		}
+		found = true
+		if rule.allows(args) {
+			return nil
+		}
+	}
+	if !found {
+		return fmt.Errorf("command %q is not allowed", cmd)
+	}
+	return fmt.Errorf("arguments of command %q are not allowed", cmd)
+}
+
+func (r CommandRule) allows(args []string) bool {
+	if len(args) > 0 && r.args == nil {
+		return false
+	}
+	for _, arg := range args {
+		if !r.args.MatchString(arg) {
+			return false
+		}
+	}
+	return true
+}
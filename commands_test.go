@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCommandAllowlistCheck(t *testing.T) {
+	allowlist := CommandAllowlist{
+		{Name: "check_load"},
+		{Name: "check_disk", Args: "/|/var"},
+		{Name: "check_procs", Args: "[a-z]+"},
+		{Name: "check_procs", Args: "[0-9]+"},
+	}
+	if err := allowlist.init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		cmd     string
+		args    []string
+		allowed bool
+	}{
+		{"check_load", nil, true},
+		// A rule without args doesn't allow any.
+		{"check_load", []string{"1"}, false},
+		{"check_disk", nil, true},
+		{"check_disk", []string{"/var"}, true},
+		{"check_disk", []string{"/", "/var"}, true},
+		// Expressions must match whole arguments.
+		{"check_disk", []string{"/etc"}, false},
+		{"check_disk", []string{"/var/log"}, false},
+		{"check_disk", []string{"x/"}, false},
+		{"check_disk", []string{"/", "/etc"}, false},
+		// Alternatives apply to the whole expression.
+		{"check_disk", []string{"/var!x"}, false},
+		// Each argument matches one rule of the command.
+		{"check_procs", []string{"sshd"}, true},
+		{"check_procs", []string{"42"}, true},
+		{"check_users", nil, false},
+		{"CHECK_LOAD", nil, false},
+	} {
+		err := allowlist.check(tc.cmd, tc.args)
+		if (err == nil) != tc.allowed {
+			t.Errorf("check(%q, %q) returned %v, want allowed %t", tc.cmd, tc.args, err, tc.allowed)
+		}
+	}
+
+	if err := CommandAllowlist(nil).check("anything", []string{"at", "all"}); err != nil {
+		t.Errorf("empty allowlist rejected a command: %s", err)
+	}
+}
+
+func TestCommandAllowlistInit(t *testing.T) {
+	for _, allowlist := range []CommandAllowlist{
+		{{Args: ".*"}},
+		{{Name: "check_disk", Args: "("}},
+	} {
+		if err := allowlist.init(); err == nil {
+			t.Errorf("init accepted %+v", allowlist)
+		}
+	}
+}
+
+// TestExportAllowedCommands checks that commands must pass both the global
+// and the module allowlist.
+func TestExportAllowedCommands(t *testing.T) {
+	module := Module{AllowedCommands: CommandAllowlist{{Name: "check_disk", Args: "/"}, {Name: "check_users"}}}
+	if err := module.init(); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		AllowedCommands: CommandAllowlist{{Name: "check_load"}, {Name: "check_disk", Args: "/.*"}},
+		Modules:         map[string]Module{"restricted": module},
+	}
+	if err := config.AllowedCommands.init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"command=check_load", 200},
+		{"command=check_disk&arg=/var", 200},
+		{"command=check_users", 403},
+		{"module=restricted&command=check_disk&arg=/", 200},
+		// Allowed globally, but not by the module.
+		{"module=restricted&command=check_load", 403},
+		{"module=restricted&command=check_disk&arg=/var", 403},
+		// Allowed by the module, but not globally.
+		{"module=restricted&command=check_users", 403},
+	} {
+		// Nothing listens on port 1, so allowed commands fail quickly.
+		w := export(t, config, "target=127.0.0.1:1&"+tc.query, nil)
+		if w.Code != tc.code {
+			t.Errorf("%s returned %d, want %d: %s", tc.query, w.Code, tc.code, w.Body)
+		}
+	}
+}
+
+// TestExportInvalidCommand checks that command names which can't label
+// metrics are rejected rather than failing the scrape.
+func TestExportInvalidCommand(t *testing.T) {
+	for _, query := range []string{
+		"command=%FF",
+		"command=check_load&command=check_%C3",
+		"command=check_load%0A",
+		"command=check_load%00&arg=1",
+	} {
+		w := export(t, &Config{}, "target=127.0.0.1:1&"+query, nil)
+		if w.Code != 400 {
+			t.Errorf("%s returned %d, want 400: %s", query, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nrpe_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nrpe_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+)
+
+// Config is the exporter configuration file.
+type Config struct {
+	Modules map[string]Module `yaml:"modules"`
+	// AllowedTargets restricts the targets of export requests, all targets
+	// are allowed if unset.
+	AllowedTargets *TargetAllowlist `yaml:"allowed_targets,omitempty"`
+	// AllowedCommands restricts the commands of all export requests.
+	AllowedCommands CommandAllowlist `yaml:"allowed_commands,omitempty"`
+	// Checks are run in the background and served on /checks.
+	Checks []Check `yaml:"checks,omitempty"`
+}
+
+// Check runs the commands of a module against targets at an interval,
+// independently of scrapes.
+type Check struct {
+	Targets  []string      `yaml:"targets"`
+	Module   string        `yaml:"module"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Module bundles the settings of a probe, selected with the module query
+// parameter.
+type Module struct {
+	// Command is the NRPE command to run. If empty, it is taken from the
+	// command and arg query parameters.
+	Command string   `yaml:"command,omitempty"`
+	Args    []string `yaml:"args,omitempty"`
+	// Commands are run together in one scrape, instead of Command.
+	Commands []ModuleCommand `yaml:"commands,omitempty"`
+	// Concurrency limits how many commands run against the target at once,
+	// --command.concurrency if unset.
+	Concurrency int `yaml:"concurrency,omitempty"`
+	// Protocol is the NRPE packet version: 2, 3, 4 or auto.
+	Protocol string `yaml:"protocol,omitempty"`
+	// Timeout bounds connecting, the TLS handshake and running the commands,
+	// if it is shorter than the scrape timeout.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// CacheTTL is how long command results are reused before running the
+	// commands again, for expensive checks. Results aren't cached if unset.
+	CacheTTL time.Duration `yaml:"cache_ttl,omitempty"`
+	// TLS enables SSL. Connections are plain TCP without it.
+	TLS      *TLSConfig     `yaml:"tls,omitempty"`
+	Perfdata PerfdataConfig `yaml:"perfdata,omitempty"`
+	// AllowedCommands restricts the commands run with the module, in
+	// addition to the global allowlist.
+	AllowedCommands CommandAllowlist `yaml:"allowed_commands,omitempty"`
+
+	// Resolved by init.
+	protocol  int16
+	transport transport
+}
+
+// ModuleCommand is one of the commands of a module.
+type ModuleCommand struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args,omitempty"`
+}
+
+// commandList returns the commands the module runs, none if they are taken
+// from the query parameters.
+func (m Module) commandList() []ModuleCommand {
+	if m.Command != "" {
+		return []ModuleCommand{{m.Command, m.Args}}
+	}
+	return m.Commands
+}
+
+// PerfdataConfig controls how performance data is exported.
+type PerfdataConfig struct {
+	// Disabled skips parsing perfdata altogether.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// RawUnits exports values in the plugin's units of measure instead of
+	// converting them to base units.
+	RawUnits bool `yaml:"raw_units,omitempty"`
+}
+
+// init validates the module and resolves its protocol version and transport.
+func (m *Module) init() error {
+	if m.Command == "" && len(m.Args) > 0 {
+		return fmt.Errorf("args given without a command")
+	}
+	if m.Command != "" && len(m.Commands) > 0 {
+		return fmt.Errorf("command and commands are mutually exclusive")
+	}
+	if err := m.AllowedCommands.init(); err != nil {
+		return fmt.Errorf("allowed_commands: %s", err)
+	}
+	seen := make(map[string]bool)
+	for _, c := range m.commandList() {
+		if c.Command == "" {
+			return fmt.Errorf("commands entry without a command")
+		}
+		// The command name labels its metrics.
+		if seen[c.Command] {
+			return fmt.Errorf("command %q is listed twice", c.Command)
+		}
+		seen[c.Command] = true
+		if _, err := joinCommand(c.Command, c.Args); err != nil {
+			return err
+		}
+		if err := m.AllowedCommands.check(c.Command, c.Args); err != nil {
+			return err
+		}
+	}
+	if m.Concurrency < 0 {
+		return fmt.Errorf("negative concurrency %d", m.Concurrency)
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("negative timeout %s", m.Timeout)
+	}
+	if m.CacheTTL < 0 {
+		return fmt.Errorf("negative cache_ttl %s", m.CacheTTL)
+	}
+
+	var err error
+	if m.protocol, err = parseProtocol(m.Protocol); err != nil {
+		return err
+	}
+	m.transport = plainTransport{}
+	if m.TLS != nil {
+		if m.transport, err = m.TLS.transport(); err != nil {
+			return fmt.Errorf("tls: %s", err)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads and validates the configuration file.
+func loadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %s", err)
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %s", err)
+	}
+	if c.AllowedTargets != nil {
+		if err := c.AllowedTargets.init(); err != nil {
+			return nil, fmt.Errorf("error in allowed_targets: %s", err)
+		}
+	}
+	if err := c.AllowedCommands.init(); err != nil {
+		return nil, fmt.Errorf("error in allowed_commands: %s", err)
+	}
+	for name, module := range c.Modules {
+		if err := module.init(); err != nil {
+			return nil, fmt.Errorf("error in module %q: %s", name, err)
+		}
+		for _, cmd := range module.commandList() {
+			if err := c.AllowedCommands.check(cmd.Command, cmd.Args); err != nil {
+				return nil, fmt.Errorf("error in module %q: %s", name, err)
+			}
+		}
+		c.Modules[name] = module
+	}
+
+	seen := make(map[string]bool)
+	for i, check := range c.Checks {
+		module, ok := c.Modules[check.Module]
+		if !ok {
+			return nil, fmt.Errorf("error in check %d: unknown module %q", i+1, check.Module)
+		}
+		if len(module.commandList()) == 0 {
+			return nil, fmt.Errorf("error in check %d: module %q doesn't set any commands", i+1, check.Module)
+		}
+		if check.Interval <= 0 {
+			return nil, fmt.Errorf("error in check %d: interval must be positive", i+1)
+		}
+		for _, target := range check.Targets {
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				return nil, fmt.Errorf("error in check %d: %s", i+1, err)
+			}
+			key := check.Module + "\x00" + target
+			if seen[key] {
+				return nil, fmt.Errorf("error in check %d: target %q is checked with module %q twice", i+1, target, check.Module)
+			}
+			seen[key] = true
+		}
+	}
+	return c, nil
+}
+
+// SafeConfig holds the current configuration, which is replaced as a whole
+// on reload.
+type SafeConfig struct {
+	mu sync.RWMutex
+	c  *Config
+}
+
+// get returns the current configuration. It is never modified, so it can be
+// used after the lock is released.
+func (sc *SafeConfig) get() *Config {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if sc.c == nil {
+		return &Config{}
+	}
+	return sc.c
+}
+
+// reload loads the configuration file and swaps it in, keeping the current
+// configuration if it is invalid.
+func (sc *SafeConfig) reload(path string) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	sc.mu.Lock()
+	sc.c = c
+	sc.mu.Unlock()
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v2"
+)
+
+// debugLogger returns a logger that records everything logged during a
+// probe in buf, at all levels, in addition to passing it on to logger.
+func debugLogger(buf *bytes.Buffer, logger log.Logger) log.Logger {
+	probeLogger := log.NewSyncLogger(log.NewLogfmtLogger(buf))
+	probeLogger = log.With(probeLogger, "ts", log.DefaultTimestampUTC)
+	return log.LoggerFunc(func(keyvals ...interface{}) error {
+		probeLogger.Log(keyvals...)
+		return logger.Log(keyvals...)
+	})
+}
+
+// debugOutput returns the report of a probe made with debug=true: the logs of
+// the probe, which include the packets exchanged and the parsed performance
+// data, the metrics it produced and the module it ran with.
+func debugOutput(module Module, logBuffer *bytes.Buffer, registry *prometheus.Registry) string {
+	// Gathering runs the probe, so do it before reading its logs.
+	metrics := &bytes.Buffer{}
+	mfs, err := registry.Gather()
+	if err != nil {
+		fmt.Fprintf(metrics, "Error gathering metrics: %s\n", err)
+	}
+	for _, mf := range mfs {
+		expfmt.MetricFamilyToText(metrics, mf)
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Logs for the probe:\n")
+	logBuffer.WriteTo(buf)
+	fmt.Fprintf(buf, "\n\nMetrics that would have been returned:\n")
+	metrics.WriteTo(buf)
+	fmt.Fprintf(buf, "\n\nModule configuration:\n")
+	c, err := yaml.Marshal(module)
+	if err != nil {
+		fmt.Fprintf(buf, "Error marshalling config: %s\n", err)
+	}
+	buf.Write(c)
+	return buf.String()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of export requests.
+const (
+	outcomeSuccess   = "success"
+	outcomeFailure   = "failure"
+	outcomeInvalid   = "invalid"
+	outcomeForbidden = "forbidden"
+)
+
+// connModePlain labels unencrypted connections in nrpe_exporter_open_connections,
+// alongside the TLS modes.
+const connModePlain = "plain"
+
+// Metrics about the exporter itself, on /metrics.
+var (
+	exportRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nrpe_exporter_export_requests_total",
+		Help: "Number of /export requests by module and outcome: success if all commands succeeded, failure if any failed, invalid or forbidden if the request was rejected.",
+	}, []string{"module", "outcome"})
+	exportDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nrpe_exporter_export_duration_seconds",
+		Help:    "Duration of /export requests by module.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"module"})
+	commandFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nrpe_exporter_command_failures_total",
+		Help: "Number of commands that failed by module and reason, as in nrpe_probe_failure_reason.",
+	}, []string{"module", "reason"})
+	probesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nrpe_exporter_probes_in_flight",
+		Help: "Number of commands being run against NRPE servers.",
+	})
+	openConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nrpe_exporter_open_connections",
+		Help: "Number of open connections to NRPE servers by SSL mode.",
+	}, []string{"mode"})
+)
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scopes of the connection limits.
+const (
+	limitScopeTarget = "target"
+	limitScopeGlobal = "global"
+)
+
+var (
+	limitQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nrpe_exporter_limit_queue_wait_seconds",
+		Help:    "Time commands waited for a connection slot, by scope of the limit.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"scope"})
+	limitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nrpe_exporter_limit_rejections_total",
+		Help: "Number of commands rejected because the wait queue for a connection slot was full, by scope of the limit.",
+	}, []string{"scope"})
+)
+
+// limitError is returned for commands rejected because a wait queue is full.
+type limitError struct {
+	scope string
+}
+
+func (e *limitError) Error() string {
+	return "too many connections waiting for a " + e.scope + " slot"
+}
+
+// slots is a counting semaphore with a bounded FIFO wait queue.
+type slots struct {
+	active  int
+	waiters []chan struct{}
+}
+
+// limiter bounds the connections to each target and in total. Commands wait
+// in a queue for a free slot, unless the queue is full.
+type limiter struct {
+	perTarget int
+	global    int
+	queueSize int
+
+	mu      sync.Mutex
+	all     slots
+	targets map[string]*slots
+}
+
+// newLimiter returns a limiter allowing perTarget connections to each target
+// and global connections overall, with at most queueSize commands waiting
+// for each. A limit of 0 disables it.
+func newLimiter(perTarget, global, queueSize int) *limiter {
+	return &limiter{
+		perTarget: perTarget,
+		global:    global,
+		queueSize: queueSize,
+		targets:   make(map[string]*slots),
+	}
+}
+
+// limitKey returns the address the per-target limit applies to, so that
+// spellings of the same host:port share their slots. Host names are only
+// resolved to IPs by the target allowlist, so a name and its IP still count
+// separately without one.
+func limitKey(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// acquire waits for a slot for target and a global one, until ctx is done.
+// The returned function releases them.
+func (l *limiter) acquire(ctx context.Context, target string) (release func(), err error) {
+	if err := l.wait(ctx, target, limitScopeTarget); err != nil {
+		return nil, err
+	}
+	if err := l.wait(ctx, target, limitScopeGlobal); err != nil {
+		l.release(target, limitScopeTarget)
+		return nil, err
+	}
+	return func() {
+		l.release(target, limitScopeGlobal)
+		l.release(target, limitScopeTarget)
+	}, nil
+}
+
+// slotsFor returns the slots and limit of scope, creating the slots of
+// target if needed. l.mu must be held.
+func (l *limiter) slotsFor(target, scope string) (*slots, int) {
+	if scope == limitScopeGlobal {
+		return &l.all, l.global
+	}
+	s, ok := l.targets[target]
+	if !ok {
+		s = &slots{}
+		l.targets[target] = s
+	}
+	return s, l.perTarget
+}
+
+func (l *limiter) wait(ctx context.Context, target, scope string) error {
+	start := time.Now()
+	l.mu.Lock()
+	s, limit := l.slotsFor(target, scope)
+	if limit <= 0 || s.active < limit {
+		s.active++
+		l.mu.Unlock()
+		limitQueueWait.WithLabelValues(scope).Observe(0)
+		return nil
+	}
+	if len(s.waiters) >= l.queueSize {
+		l.mu.Unlock()
+		limitRejections.WithLabelValues(scope).Inc()
+		return &limitError{scope}
+	}
+	ready := make(chan struct{})
+	s.waiters = append(s.waiters, ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		limitQueueWait.WithLabelValues(scope).Observe(time.Since(start).Seconds())
+		return nil
+	case <-ctx.Done():
+	}
+	limitQueueWait.WithLabelValues(scope).Observe(time.Since(start).Seconds())
+	l.mu.Lock()
+	for i, w := range s.waiters {
+		if w == ready {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	l.mu.Unlock()
+	// The slot was handed over as ctx was done.
+	l.release(target, scope)
+	return ctx.Err()
+}
+
+// release frees a slot of scope, handing it to the first waiting command.
+func (l *limiter) release(target, scope string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked(target, scope)
+}
+
+// releaseLocked is release with l.mu held.
+func (l *limiter) releaseLocked(target, scope string) {
+	s, _ := l.slotsFor(target, scope)
+	if len(s.waiters) > 0 {
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+		return
+	}
+	s.active--
+	if scope == limitScopeTarget && s.active == 0 {
+		delete(l.targets, target)
+	}
+}
+
+// isLimitError reports whether err is due to a full wait queue.
+func isLimitError(err error) bool {
+	var limitErr *limitError
+	return errors.As(err, &limitErr)
+}
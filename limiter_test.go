@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n commands wait for a slot of target.
+func waitQueued(t *testing.T, l *limiter, target string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		queued := 0
+		if s, ok := l.targets[target]; ok {
+			queued = len(s.waiters)
+		}
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d commands wait for a slot, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// checkIdle checks that l holds no slots.
+func checkIdle(t *testing.T, l *limiter) {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.targets) != 0 || l.all.active != 0 || len(l.all.waiters) != 0 {
+		t.Errorf("idle limiter has %d targets and %d global slots in use", len(l.targets), l.all.active)
+	}
+}
+
+func TestLimiterFIFO(t *testing.T) {
+	l := newLimiter(1, 0, 10)
+	release, err := l.acquire(context.Background(), "a:5666")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other targets have their own slots.
+	other, err := l.acquire(context.Background(), "b:5666")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	type acquired struct {
+		i       int
+		release func()
+	}
+	order := make(chan acquired)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			release, err := l.acquire(context.Background(), "a:5666")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- acquired{i, release}
+		}(i)
+		waitQueued(t, l, "a:5666", i+1)
+	}
+
+	release()
+	for i := 0; i < 3; i++ {
+		a := <-order
+		if a.i != i {
+			t.Errorf("command %d got slot %d", a.i, i)
+		}
+		a.release()
+	}
+	checkIdle(t, l)
+}
+
+func TestLimiterQueueFull(t *testing.T) {
+	l := newLimiter(1, 0, 1)
+	release, err := l.acquire(context.Background(), "a:5666")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error)
+	go func() {
+		release, err := l.acquire(context.Background(), "a:5666")
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	waitQueued(t, l, "a:5666", 1)
+
+	_, err = l.acquire(context.Background(), "a:5666")
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) || limitErr.scope != limitScopeTarget {
+		t.Errorf("acquire with a full queue returned %v", err)
+	}
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("queued command returned %v", err)
+	}
+	checkIdle(t, l)
+
+	// A rejection by the global limit gives back the target slot.
+	l = newLimiter(1, 1, 0)
+	release, err = l.acquire(context.Background(), "a:5666")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.acquire(context.Background(), "b:5666")
+	if !errors.As(err, &limitErr) || limitErr.scope != limitScopeGlobal {
+		t.Errorf("acquire over the global limit returned %v", err)
+	}
+	release()
+	checkIdle(t, l)
+}
+
+func TestLimiterCancelledWaiter(t *testing.T) {
+	l := newLimiter(1, 0, 10)
+	if _, err := l.acquire(context.Background(), "a:5666"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancelled before a slot was handed over.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := l.acquire(ctx, "a:5666")
+		cancelled <- err
+	}()
+	waitQueued(t, l, "a:5666", 1)
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled command returned %v", err)
+	}
+	waitQueued(t, l, "a:5666", 0)
+
+	// Cancelled as a slot was handed over, which goes to the next command.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := l.acquire(ctx, "a:5666")
+		cancelled <- err
+	}()
+	waitQueued(t, l, "a:5666", 1)
+	next := make(chan func())
+	go func() {
+		release, err := l.acquire(context.Background(), "a:5666")
+		if err != nil {
+			t.Error(err)
+		}
+		next <- release
+	}()
+	waitQueued(t, l, "a:5666", 2)
+	l.mu.Lock()
+	cancel()
+	// The cancelled command can't take the lock to leave the queue before
+	// its slot is handed over.
+	time.Sleep(10 * time.Millisecond)
+	// What release does, with the lock already held.
+	l.releaseLocked("a:5666", limitScopeGlobal)
+	l.releaseLocked("a:5666", limitScopeTarget)
+	l.mu.Unlock()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled command returned %v", err)
+	}
+	select {
+	case release := <-next:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slot handed to the cancelled command was lost")
+	}
+	checkIdle(t, l)
+}
@@ -2,10 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	nrpe "github.com/canonical/nrped/common"
@@ -16,163 +23,705 @@ import (
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
-	"github.com/spacemonkeygo/openssl"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
-	listenAddress = kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests.").Default(":9275").String()
+	listenAddress      = kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests.").Default(":9275").String()
+	commandConcurrency = kingpin.Flag("command.concurrency", "Maximum number of commands run at once against a target in a scrape. Modules can override it.").Default("4").Int()
+	legacyMetricNames  = kingpin.Flag("compat.legacy-metric-names", "Also export command_duration, command_ok and command_status under their old unprefixed names.").Bool()
+	limitPerTarget     = kingpin.Flag("limit.per-target", "Maximum number of connections to a target at once across all scrapes, 0 for no limit.").Default("4").Int()
+	limitGlobal        = kingpin.Flag("limit.global", "Maximum number of connections to NRPE servers at once, 0 for no limit.").Default("256").Int()
+	limitQueueSize     = kingpin.Flag("limit.queue-size", "Maximum number of commands waiting for a connection to a target, and overall, before further ones are rejected.").Default("64").Int()
+	timeoutOffset      = kingpin.Flag("timeout-offset", "Offset to subtract from the Prometheus scrape timeout in seconds.").Default("0.5").Float64()
+	configFile         = kingpin.Flag("config.file", "Configuration file with modules selectable with the module parameter.").String()
+	tlsCAFile          = kingpin.Flag("tls.ca-file", "CA certificates to verify NRPE servers against with ssl=verify. Defaults to the system CAs.").String()
+	tlsCertFile        = kingpin.Flag("tls.cert-file", "Client certificate to present to NRPE servers with ssl=verify or ssl=insecure.").String()
+	tlsKeyFile         = kingpin.Flag("tls.key-file", "Key of the client certificate.").String()
+	tlsServerName      = kingpin.Flag("tls.server-name", "Server name to verify NRPE certificates against with ssl=verify. Defaults to the target host.").String()
+	tlsMinVersion      = kingpin.Flag("tls.min-version", "Minimum TLS version accepted with ssl=verify or ssl=insecure (TLS10, TLS11, TLS12 or TLS13).").Default("TLS12").String()
+	tlsCiphers         = kingpin.Flag("tls.ciphers", "Cipher suites offered with ssl=verify or ssl=insecure, by Go name. May be repeated. Defaults to Go's choice.").Strings()
+
+	commandDurationDesc = prometheus.NewDesc("nrpe_command_duration_seconds", "Length of time the NRPE command took, from sending the query to reading the response", []string{"command"}, nil)
+	commandOkDesc       = prometheus.NewDesc("nrpe_command_ok", "Whether the command returned OK (status 0)", []string{"command"}, nil)
+	commandStatusDesc   = prometheus.NewDesc("nrpe_command_status", "Status the command returned: 0 OK, 1 warning, 2 critical, 3 unknown", []string{"command"}, nil)
+	protocolVersionDesc = prometheus.NewDesc("nrpe_protocol_version", "NRPE packet version used to run the command", []string{"command"}, nil)
+	responsePacketsDesc = prometheus.NewDesc("nrpe_response_packets", "Number of packets the NRPE server sent in its response", []string{"command"}, nil)
+	upDesc              = prometheus.NewDesc("nrpe_up", "Whether the NRPE server answered any of the commands", nil, nil)
+	probeSuccessDesc    = prometheus.NewDesc("nrpe_probe_success", "Whether the command was run and its result received", []string{"command"}, nil)
+	failureReasonDesc   = prometheus.NewDesc("nrpe_probe_failure_reason", "Why the command failed, if it did", []string{"command", "reason"}, nil)
+	phaseDurationDesc   = prometheus.NewDesc("nrpe_phase_duration_seconds", "Duration of the phases of running the command", []string{"command", "phase"}, nil)
+	resultAgeDesc       = prometheus.NewDesc("nrpe_result_age_seconds", "Time since the result was received from the NRPE server, for modules with a cache TTL", []string{"command"}, nil)
+	timeoutDesc         = prometheus.NewDesc("nrpe_timeout", "Whether the command timed out or the scrape was cancelled", []string{"command"}, nil)
+	packetErrorDesc     = prometheus.NewDesc("nrpe_packet_error", "Whether the response from the NRPE server failed validation, by reason", []string{"command", "reason"}, nil)
+
+	tlsInfoDesc              = prometheus.NewDesc("nrpe_tls_info", "TLS mode, version and cipher suite negotiated with the NRPE server", []string{"command", "mode", "version", "cipher"}, nil)
+	tlsHandshakeDurationDesc = prometheus.NewDesc("nrpe_tls_handshake_duration_seconds", "Length of time the TLS handshake took", []string{"command"}, nil)
+	tlsCertExpiryDesc        = prometheus.NewDesc("nrpe_tls_cert_expiry_timestamp_seconds", "Time the NRPE server certificate expires, in seconds since the epoch", []string{"command"}, nil)
+
+	// Unprefixed names of the command metrics before they were namespaced,
+	// exported with --compat.legacy-metric-names.
+	legacyCommandDurationDesc = prometheus.NewDesc("command_duration", "Length of time the NRPE command took", []string{"command"}, nil)
+	legacyCommandOkDesc       = prometheus.NewDesc("command_ok", "Indicates whether or not the command was a success", []string{"command"}, nil)
+	legacyCommandStatusDesc   = prometheus.NewDesc("command_status", "Indicates the status of the command", []string{"command"}, nil)
 )
 
-// Collector type containing issued command and a logger
+// Reasons a command fails.
+const (
+	reasonDNS            = "dns"
+	reasonConnectRefused = "connect_refused"
+	reasonConnect        = "connect"
+	reasonTimeout        = "timeout"
+	reasonTLS            = "tls"
+	reasonProtocol       = "protocol"
+	reasonLimit          = "limit"
+)
+
+var failureReasons = []string{reasonDNS, reasonConnectRefused, reasonConnect, reasonTimeout, reasonTLS, reasonProtocol, reasonLimit}
+
+// Phases of running a command.
+const (
+	phaseDNS     = "dns"
+	phaseConnect = "connect"
+	phaseTLS     = "tls"
+	phaseSend    = "send"
+	phaseReceive = "receive"
+)
+
+var phases = []string{phaseDNS, phaseConnect, phaseTLS, phaseSend, phaseReceive}
+
+// Collector type containing issued commands and a logger
 type Collector struct {
-	command string
-	target  string
-	ssl     bool
-	logger  log.Logger
+	ctx      context.Context
+	commands []nrpeCommand
+	target   string
+	address  string
+	module   Module
+	limiter  *limiter
+	logger   log.Logger
+
+	// probeKey identifies identical probes together with the command. flights
+	// deduplicates those in flight and cache holds their results for the
+	// module cache TTL.
+	probeKey string
+	flights  *flightGroup
+	cache    *resultCache
+	// reportAge exports the age of the results, which may be older than the
+	// scrape.
+	reportAge bool
+	// lookupErr is set if the target couldn't be resolved to check it
+	// against the allowlist, and fails every command.
+	lookupErr error
+	// lookupDuration is how long resolving the target for the allowlist
+	// took, in seconds. It is part of the dns phase of every command.
+	lookupDuration float64
+
+	// The results of the last run, by command. failureReasons are empty
+	// for commands that succeeded.
+	results        []CommandResult
+	errs           []error
+	failureReasons []string
+}
+
+// nrpeCommand is a command to run, with its arguments.
+type nrpeCommand struct {
+	// name is the command name, which labels its metrics.
+	name string
+	// query is the command and its arguments as sent to the NRPE server.
+	query string
 }
 
 // CommandResult type describing the result of command against nrpe-server
 type CommandResult struct {
 	commandDuration float64
 	statusOk        float64
-	result          *nrpe.NrpePacket
+	result          *packet
+	packets         int
+	perfdata        []perfdatum
+	tls             *tlsState
+	// timestamp is when the response was received.
+	timestamp time.Time
+	// phases are the durations of the phases of the probe by name, in
+	// seconds.
+	phases map[string]float64
 }
 
-// Describe implemented with dummy data to satisfy interface
+// Describe sends the descriptors of all metrics the collector exports.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+	for _, desc := range []*prometheus.Desc{
+		upDesc, probeSuccessDesc, failureReasonDesc, phaseDurationDesc, timeoutDesc, packetErrorDesc,
+		tlsInfoDesc, tlsHandshakeDurationDesc, tlsCertExpiryDesc,
+		commandDurationDesc, commandOkDesc, commandStatusDesc, protocolVersionDesc, responsePacketsDesc, resultAgeDesc,
+		perfdataCounterDesc, perfdataThresholdInsideDesc,
+	} {
+		ch <- desc
+	}
+	for _, descs := range perfdataDescsByUnit {
+		ch <- descs.value
+		ch <- descs.threshold
+		ch <- descs.min
+		ch <- descs.max
+	}
+	if *legacyMetricNames {
+		ch <- legacyCommandDurationDesc
+		ch <- legacyCommandOkDesc
+		ch <- legacyCommandStatusDesc
+	}
 }
 
-func collectCommandMetrics(cmd string, conn net.Conn, logger log.Logger) (CommandResult, error) {
-	// Parse and issue given command
-	command := nrpe.PrepareToSend(cmd, nrpe.QUERY_PACKET)
+func collectCommandMetrics(cmd string, version int16, conn net.Conn, perfdataConfig PerfdataConfig, logger log.Logger) (CommandResult, error) {
+	// Issue given command
+	phases := make(map[string]float64)
 	startTime := time.Now()
-	err := nrpe.SendPacket(conn, command)
+	query, err := sendQuery(conn, version, cmd)
+	phases[phaseSend] = time.Since(startTime).Seconds()
 	if err != nil {
 		return CommandResult{
 			commandDuration: time.Since(startTime).Seconds(),
 			statusOk:        0,
 			result:          nil,
+			phases:          phases,
 		}, err
 	}
 
-	result, err := nrpe.ReceivePacket(conn)
+	level.Debug(logger).Log(append([]interface{}{"msg", "Sent query", "command", cmd}, query.logFields()...)...)
+
+	receiveTime := time.Now()
+	result, packets, err := readResponse(conn, version)
+	phases[phaseReceive] = time.Since(receiveTime).Seconds()
+	if result.raw != nil {
+		level.Debug(logger).Log(append([]interface{}{"msg", "Received response", "command", cmd, "packets", packets}, result.logFields()...)...)
+	}
 	if err != nil {
-		level.Error(logger).Log("msg", "ERROR!", err)
 		return CommandResult{
 			commandDuration: time.Since(startTime).Seconds(),
 			statusOk:        0,
 			result:          nil,
+			phases:          phases,
 		}, err
 	}
 
 	duration := time.Since(startTime).Seconds()
 	ipaddr, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-	output := result.CommandBuffer[:]
+	output := result.output()
 	level.Info(logger).Log("msg", "Command returned", "command", cmd,
-		"address", ipaddr, "duration", duration, "return_code", result.ResultCode,
-		"command_output", fmt.Sprintf("%s", bytes.Trim(output, "\x00")))
+		"address", ipaddr, "duration", duration, "return_code", result.resultCode,
+		"packet_version", result.version, "packets", packets, "command_output", output)
 	statusOk := 1.0
-	if result.ResultCode != 0 {
+	if result.resultCode != 0 {
 		statusOk = 0
 	}
-	return CommandResult{duration, statusOk, &result}, nil
+
+	var perfdata []perfdatum
+	if !perfdataConfig.Disabled {
+		_, perf := splitOutput(output)
+		var errs []error
+		perfdata, errs = parsePerfdata(perf)
+		for _, err := range errs {
+			level.Warn(logger).Log("msg", "Error parsing performance data", "command", cmd, "err", err)
+		}
+		if !perfdataConfig.RawUnits {
+			for i := range perfdata {
+				perfdata[i].normalise()
+			}
+		}
+		for _, p := range perfdata {
+			level.Debug(logger).Log("msg", "Parsed performance data", "command", cmd, "label", p.label,
+				"value", p.value, "uom", p.uom, "unit", p.unit, "counter", p.counter,
+				"warning", p.warn.String(), "critical", p.crit.String(), "min", formatOptional(p.min), "max", formatOptional(p.max))
+		}
+	}
+	return CommandResult{
+		commandDuration: duration,
+		statusOk:        statusOk,
+		result:          &result,
+		packets:         packets,
+		perfdata:        perfdata,
+		timestamp:       time.Now(),
+		phases:          phases,
+	}, nil
 }
 
-// Collect dials nrpe-server and issues given command, recording metrics based on the result.
-func (c *Collector) Collect(ch chan<- prometheus.Metric) {
-	var ctx *openssl.Ctx
-	var conn net.Conn
-	var err error
+// probe runs cmd once a connection slot is free. If flights is set, it
+// shares the result of an identical probe in flight instead, and if the
+// module has a cache TTL, it returns a cached result while there is one.
+func (c *Collector) probe(cmd string) (CommandResult, error) {
+	if c.lookupErr != nil {
+		return CommandResult{phases: map[string]float64{phaseDNS: c.lookupDuration}}, c.lookupErr
+	}
+	key := c.probeKey + "\x00" + cmd
+	useCache := c.cache != nil && c.module.CacheTTL > 0
+	if useCache {
+		if result, ok := c.cache.get(key); ok {
+			level.Debug(c.logger).Log("msg", "Using cached result", "command", cmd, "age", time.Since(result.timestamp))
+			return result, nil
+		}
+	}
 
-	// Connect to NRPE server
-	if c.ssl {
-		ctx, err = openssl.NewCtx()
+	run := func() (CommandResult, error) {
+		release, err := c.limiter.acquire(c.ctx, limitKey(c.address))
 		if err != nil {
-			level.Error(c.logger).Log("msg", "Error creating SSL context", "err", err)
-			return
+			return CommandResult{}, fmt.Errorf("command not run: %w", err)
 		}
-		err = ctx.SetCipherList("ALL:!MD5:@STRENGTH")
+		defer release()
+		probesInFlight.Inc()
+		defer probesInFlight.Dec()
+		return c.runCommand(cmd)
+	}
+	var result CommandResult
+	var err error
+	if c.flights == nil {
+		result, err = run()
+	} else {
+		result, err = c.flights.do(c.ctx, key, run)
+	}
+	if useCache && err == nil {
+		c.cache.put(key, result, c.module.CacheTTL)
+	}
+	return result, err
+}
+
+// runCommand dials the NRPE server and issues cmd. In auto protocol
+// mode it starts with the newest packet version and redials with older ones
+// while the daemon rejects them, as check_nrpe does, and stops at any other
+// error.
+func (c *Collector) runCommand(cmd string) (CommandResult, error) {
+	versions := []int16{c.module.protocol}
+	if c.module.protocol == protocolAuto {
+		versions = []int16{nrpePacketVersion4, nrpe.NRPE_PACKET_VERSION_3, nrpe.NRPE_PACKET_VERSION_2}
+	}
+
+	// Certificates are verified against the target host even if the
+	// allowlist resolved it to an IP.
+	serverName, _, _ := net.SplitHostPort(c.target)
+
+	var cmdResult CommandResult
+	var err error
+	for _, version := range versions {
+		var conn net.Conn
+		var tls *tlsState
+		trace := &dialTrace{}
+		conn, tls, err = c.module.transport.Dial(withDialTrace(c.ctx, trace), c.address, serverName)
+		trace.dns += c.lookupDuration
 		if err != nil {
-			level.Error(c.logger).Log("msg", "Error setting SSL cipher list", "err", err)
-			return
+			cmdResult = CommandResult{phases: make(map[string]float64)}
+			trace.record(cmdResult.phases)
+			return cmdResult, fmt.Errorf("error dialing NRPE server: %w", err)
 		}
-		conn, err = openssl.Dial("tcp", c.target, ctx, openssl.InsecureSkipHostVerification)
-		if conn == (*openssl.Conn)(nil) || err != nil {
-			level.Error(c.logger).Log("msg", "Error dialing NRPE server", "err", err)
-			return
+
+		level.Debug(c.logger).Log("msg", "Connected to NRPE server", "target", c.target, "address", conn.RemoteAddr(), "packet_version", version)
+		if tls != nil {
+			keyvals := []interface{}{"msg", "TLS session established", "mode", tls.mode, "version", tls.version,
+				"cipher", tls.cipher, "handshake_duration", tls.handshakeDuration}
+			if !tls.certExpiry.IsZero() {
+				keyvals = append(keyvals, "cert_expiry", tls.certExpiry)
+			}
+			level.Debug(c.logger).Log(keyvals...)
 		}
-	} else {
-		d := net.Dialer{}
-		conn, err = d.Dial("tcp", c.target)
-		if err != nil {
-			level.Error(c.logger).Log("msg", "Error dialing NRPE server", "err", err)
-			return
+
+		connMode := connModePlain
+		if tls != nil {
+			connMode = tls.mode
 		}
+		openConnections.WithLabelValues(connMode).Inc()
+
+		stop := interruptOnCancel(c.ctx, conn)
+		cmdResult, err = collectCommandMetrics(cmd, version, conn, c.module.Perfdata, c.logger)
+		stop()
+		cmdResult.tls = tls
+		trace.record(cmdResult.phases)
+
+		// Make sure the connection is closed, since it will re-dial on the next check
+		if cerr := conn.Close(); cerr != nil {
+			level.Error(c.logger).Log("msg", "Could not close connection to NRPE server", "target", c.target, "err", cerr)
+		}
+		openConnections.WithLabelValues(connMode).Dec()
+		// Only redial if the daemon refused the version before running the
+		// command, so that it never runs twice.
+		var rejected *versionRejectedError
+		if !errors.As(err, &rejected) || c.ctx.Err() != nil {
+			break
+		}
+		level.Debug(c.logger).Log("msg", "NRPE server did not answer query", "target", c.target, "packet_version", version, "err", err)
 	}
-	defer conn.Close()
+	return cmdResult, err
+}
 
-	cmdResult, err := collectCommandMetrics(c.command, conn, c.logger)
+// Collect dials nrpe-server and issues the commands, recording metrics
+// based on the results.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.run()
+	c.collectResults(ch)
+}
+
+// run issues the commands, at most concurrency at a time, and keeps their
+// results for collectResults.
+func (c *Collector) run() {
+	concurrency := c.module.Concurrency
+	if concurrency == 0 {
+		concurrency = *commandConcurrency
+	}
+	results := make([]CommandResult, len(c.commands))
+	errs := make([]error, len(c.commands))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, cmd := range c.commands {
+		wg.Add(1)
+		go func(i int, cmd nrpeCommand) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				results[i], errs[i] = c.probe(cmd.query)
+			case <-c.ctx.Done():
+				errs[i] = fmt.Errorf("command not run: %w", c.ctx.Err())
+			}
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	c.results, c.errs = results, errs
+	c.failureReasons = make([]string, len(c.commands))
+	for i, cmd := range c.commands {
+		if errs[i] != nil {
+			level.Error(c.logger).Log("msg", "Error running command", "command", cmd.query, "err", errs[i])
+			c.failureReasons[i] = c.failureReason(errs[i])
+		}
+	}
+}
+
+// collectResults records metrics based on the results of the last run.
+func (c *Collector) collectResults(ch chan<- prometheus.Metric) {
+	up := 0.0
+	for i, cmd := range c.commands {
+		if c.errs[i] == nil {
+			up = 1
+		}
+		c.collectResult(ch, cmd, c.results[i], c.errs[i], c.failureReasons[i])
+	}
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, up)
+}
+
+// isTimeout reports whether err is due to the scrape deadline expiring or
+// the scrape being cancelled.
+func (c *Collector) isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if c.ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// failureReason classifies the error of a command as one of
+// failureReasons, for nrpe_probe_failure_reason.
+func (c *Collector) failureReason(err error) string {
+	var dnsErr *net.DNSError
+	var hsErr *handshakeError
+	var opErr *net.OpError
+	switch {
+	case c.isTimeout(err):
+		return reasonTimeout
+	case isLimitError(err):
+		return reasonLimit
+	case errors.As(err, &dnsErr):
+		return reasonDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return reasonConnectRefused
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return reasonConnect
+	case errors.As(err, &hsErr):
+		return reasonTLS
+	}
+	return reasonProtocol
+}
+
+// collectResult records the metrics of a single command.
+func (c *Collector) collectResult(ch chan<- prometheus.Metric, cmd nrpeCommand, cmdResult CommandResult, err error, reason string) {
+	var pktErr *packetError
+	errors.As(err, &pktErr)
+	for _, reason := range packetErrorReasons {
+		value := 0.0
+		if pktErr != nil && pktErr.reason == reason {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(packetErrorDesc, prometheus.GaugeValue, value, cmd.name, reason)
+	}
+	success := 1.0
+	if err != nil {
+		success = 0
+	}
+	ch <- prometheus.MustNewConstMetric(probeSuccessDesc, prometheus.GaugeValue, success, cmd.name)
+	for _, r := range failureReasons {
+		value := 0.0
+		if r == reason {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(failureReasonDesc, prometheus.GaugeValue, value, cmd.name, r)
+	}
+	for _, phase := range phases {
+		ch <- prometheus.MustNewConstMetric(phaseDurationDesc, prometheus.GaugeValue, cmdResult.phases[phase], cmd.name, phase)
+	}
+	timedOut := 0.0
+	if reason == reasonTimeout {
+		timedOut = 1
+	}
+	ch <- prometheus.MustNewConstMetric(timeoutDesc, prometheus.GaugeValue, timedOut, cmd.name)
+	if tls := cmdResult.tls; tls != nil {
+		ch <- prometheus.MustNewConstMetric(tlsInfoDesc, prometheus.GaugeValue, 1, cmd.name, tls.mode, tls.version, tls.cipher)
+		ch <- prometheus.MustNewConstMetric(tlsHandshakeDurationDesc, prometheus.GaugeValue, tls.handshakeDuration, cmd.name)
+		if !tls.certExpiry.IsZero() {
+			ch <- prometheus.MustNewConstMetric(tlsCertExpiryDesc, prometheus.GaugeValue, float64(tls.certExpiry.Unix()), cmd.name)
+		}
+	}
 	if err != nil {
-		level.Error(c.logger).Log("msg", "Error running command", "command", c.command, "err", err)
 		return
 	}
 
 	// Create metrics based on results of given command
-	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc("command_duration", "Length of time the NRPE command took", nil, nil),
-		prometheus.GaugeValue,
-		cmdResult.commandDuration,
-	)
-	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc("command_ok", "Indicates whether or not the command was a success", nil, nil),
-		prometheus.GaugeValue,
-		cmdResult.statusOk,
-	)
-	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc("command_status", "Indicates the status of the command", nil, nil),
-		prometheus.GaugeValue,
-		float64(cmdResult.result.ResultCode),
-	)
-
-	// Make sure the connection is closed, since it will re-dial on the next check
-	// Closing a connection more than once is fine. The defer above will simply noop, as it's already closed
-	err = conn.Close()
-	if err != nil {
-		level.Error(c.logger).Log("msg", "Could not close connection to NRPE server", "target", c.target, "err", err)
+	ch <- prometheus.MustNewConstMetric(commandDurationDesc, prometheus.GaugeValue, cmdResult.commandDuration, cmd.name)
+	ch <- prometheus.MustNewConstMetric(commandOkDesc, prometheus.GaugeValue, cmdResult.statusOk, cmd.name)
+	ch <- prometheus.MustNewConstMetric(commandStatusDesc, prometheus.GaugeValue, float64(cmdResult.result.resultCode), cmd.name)
+	if *legacyMetricNames {
+		ch <- prometheus.MustNewConstMetric(legacyCommandDurationDesc, prometheus.GaugeValue, cmdResult.commandDuration, cmd.name)
+		ch <- prometheus.MustNewConstMetric(legacyCommandOkDesc, prometheus.GaugeValue, cmdResult.statusOk, cmd.name)
+		ch <- prometheus.MustNewConstMetric(legacyCommandStatusDesc, prometheus.GaugeValue, float64(cmdResult.result.resultCode), cmd.name)
+	}
+	ch <- prometheus.MustNewConstMetric(protocolVersionDesc, prometheus.GaugeValue, float64(cmdResult.result.version), cmd.name)
+	ch <- prometheus.MustNewConstMetric(responsePacketsDesc, prometheus.GaugeValue, float64(cmdResult.packets), cmd.name)
+	if c.reportAge {
+		ch <- prometheus.MustNewConstMetric(resultAgeDesc, prometheus.GaugeValue, time.Since(cmdResult.timestamp).Seconds(), cmd.name)
+	}
+	seen := make(map[string]bool)
+	for _, p := range cmdResult.perfdata {
+		// Plugins occasionally repeat a label, which the registry would reject.
+		if seen[p.label] {
+			level.Warn(c.logger).Log("msg", "Duplicate performance data label", "command", cmd.query, "label", p.label)
+			continue
+		}
+		seen[p.label] = true
+		for _, m := range p.metrics(cmd.name) {
+			ch <- m
+		}
 	}
 }
 
-// NewCollector returns new collector with logger and given command
-func NewCollector(command, target string, ssl bool, logger log.Logger) *Collector {
+// NewCollector returns new collector with logger and given commands
+// and target. address is where target is reached, as checked against the
+// target allowlist. Commands are aborted when ctx is done.
+func NewCollector(ctx context.Context, commands []nrpeCommand, target, address string, module Module, limiter *limiter, logger log.Logger) *Collector {
 	return &Collector{
-		command: command,
-		target:  target,
-		ssl:     ssl,
-		logger:  logger,
+		ctx:      ctx,
+		commands: commands,
+		target:   target,
+		address:  address,
+		module:   module,
+		limiter:  limiter,
+		logger:   logger,
 	}
 }
 
-func handler(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+// getTimeout returns how long a scrape may take: the Prometheus scrape
+// timeout less offset, or the module timeout if that is shorter.
+func getTimeout(r *http.Request, module Module, offset float64) (time.Duration, error) {
+	// Requests not made by Prometheus, such as manual ones, get two minutes.
+	timeoutSeconds := 120.0
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		var err error
+		timeoutSeconds, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to parse timeout from Prometheus header: %s", err)
+		}
+	}
+	if timeoutSeconds > offset {
+		timeoutSeconds -= offset
+	}
+	timeout := time.Duration(timeoutSeconds * float64(time.Second))
+	if module.Timeout > 0 && module.Timeout < timeout {
+		timeout = module.Timeout
+	}
+	return timeout, nil
+}
+
+func handler(w http.ResponseWriter, r *http.Request, config *Config, transports map[string]transport, limiter *limiter, flights *flightGroup, cache *resultCache, logger log.Logger) {
+	start := time.Now()
+	// The module label is only set once the module is known to exist, so
+	// arbitrary parameters can't create new series.
+	moduleLabel := ""
+	outcome := outcomeInvalid
+	defer func() {
+		exportRequests.WithLabelValues(moduleLabel, outcome).Inc()
+		exportDuration.WithLabelValues(moduleLabel).Observe(time.Since(start).Seconds())
+	}()
+
 	params := r.URL.Query()
 	target := params.Get("target")
 	if target == "" {
 		http.Error(w, "Target parameter is missing", 400)
 		return
 	}
-	cmd := params.Get("command")
-	if cmd == "" {
+	debug := params.Get("debug") == "true"
+	var logBuffer bytes.Buffer
+	if debug {
+		logger = debugLogger(&logBuffer, logger)
+	}
+
+	var module Module
+	if moduleName := params.Get("module"); moduleName != "" {
+		var ok bool
+		module, ok = config.Modules[moduleName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), 400)
+			return
+		}
+		moduleLabel = moduleName
+		for _, param := range []string{"ssl", "protocol"} {
+			if params.Get(param) != "" {
+				http.Error(w, fmt.Sprintf("The %s parameter can't be used with a module", param), 400)
+				return
+			}
+		}
+	} else {
+		module = Module{Protocol: params.Get("protocol")}
+		if err := module.init(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		sslParam := params.Get("ssl")
+		var ok bool
+		module.transport, ok = transports[sslParam]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown ssl mode %q", sslParam), 400)
+			return
+		}
+	}
+
+	// The deadline covers resolving the target for the allowlist too.
+	timeout, err := getTimeout(r, module, *timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	address := target
+	// Targets that can't be resolved to check them aren't rejected, their
+	// probes fail as they would without an allowlist.
+	var lookupErr error
+	lookupTrace := &dialTrace{}
+	if config.AllowedTargets != nil {
+		address, err = config.AllowedTargets.check(withDialTrace(ctx, lookupTrace), target)
+		var rejected *targetRejectedError
+		var lookup *targetLookupError
+		switch {
+		case errors.As(err, &lookup):
+			lookupErr = err
+			level.Debug(logger).Log("msg", "Target can't be checked", "target", target, "err", err)
+		case errors.As(err, &rejected):
+			targetRejections.WithLabelValues(rejected.reason).Inc()
+			outcome = outcomeForbidden
+			level.Debug(logger).Log("msg", "Rejected target", "target", target, "err", err)
+			http.Error(w, fmt.Sprintf("Target not allowed: %s", err), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Invalid target: %s", err), 400)
+			return
+		default:
+			level.Debug(logger).Log("msg", "Target allowed", "target", target, "address", address)
+		}
+	}
+
+	commandList := module.commandList()
+	if len(commandList) == 0 {
+		names, args := params["command"], params["arg"]
+		if len(names) > 1 && len(args) > 0 {
+			http.Error(w, "The arg parameter can't be used with several commands", 400)
+			return
+		}
+		for _, name := range names {
+			commandList = append(commandList, ModuleCommand{name, args})
+		}
+	} else if params.Get("command") != "" || len(params["arg"]) > 0 {
+		http.Error(w, "The command and arg parameters can't be used with a module that sets commands", 400)
+		return
+	}
+	if len(commandList) == 0 {
 		http.Error(w, "Command parameter is missing", 400)
 		return
 	}
-	sslParam := params.Get("ssl")
-	ssl := sslParam == "true"
+
+	var commands []nrpeCommand
+	seen := make(map[string]bool)
+	for _, c := range commandList {
+		if c.Command == "" {
+			http.Error(w, "Command parameter is empty", 400)
+			return
+		}
+		if seen[c.Command] {
+			http.Error(w, fmt.Sprintf("Command %q is given twice", c.Command), 400)
+			return
+		}
+		seen[c.Command] = true
+		for _, allowlist := range []CommandAllowlist{config.AllowedCommands, module.AllowedCommands} {
+			if err := allowlist.check(c.Command, c.Args); err != nil {
+				level.Debug(logger).Log("msg", "Rejected command", "command", c.Command, "err", err)
+				outcome = outcomeForbidden
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		query, err := joinCommand(c.Command, c.Args)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		commands = append(commands, nrpeCommand{name: c.Command, query: query})
+	}
+
 	registry := prometheus.NewRegistry()
-	collector := NewCollector(cmd, target, ssl, logger)
+	collector := NewCollector(ctx, commands, target, address, module, limiter, logger)
+	collector.reportAge = module.CacheTTL > 0
+	collector.lookupErr = lookupErr
+	collector.lookupDuration = lookupTrace.dns
+	// Debug probes run on their own so their logs are complete.
+	if !debug {
+		collector.flights = flights
+		collector.cache = cache
+		collector.probeKey = strings.Join([]string{moduleLabel, params.Get("ssl"), params.Get("protocol"), target, address}, "\x00")
+	}
 	registry.MustRegister(collector)
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-	h.ServeHTTP(w, r)
+	if debug {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(debugOutput(module, &logBuffer, registry)))
+	} else {
+		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+		h.ServeHTTP(w, r)
+	}
+
+	outcome = outcomeSuccess
+	for _, reason := range collector.failureReasons {
+		if reason != "" {
+			outcome = outcomeFailure
+			commandFailures.WithLabelValues(moduleLabel, reason).Inc()
+		}
+	}
+}
+
+// reloadConfig reloads the configuration file, if there is one, and
+// reschedules the background checks.
+func reloadConfig(sc *SafeConfig, sched *scheduler, logger log.Logger) error {
+	if *configFile == "" {
+		return errors.New("no configuration file given with --config.file")
+	}
+	if err := sc.reload(*configFile); err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "Reloaded config file", "file", *configFile, "modules", len(sc.get().Modules))
+	sched.update(sc.get())
+	return nil
 }
 
 func main() {
@@ -185,6 +734,70 @@ func main() {
 	logger := promlog.New(&logConfig)
 	level.Info(logger).Log("msg", "Starting nrpe_exporter", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
+
+	transports, err := sslTransports(TLSConfig{
+		CAFile:     *tlsCAFile,
+		CertFile:   *tlsCertFile,
+		KeyFile:    *tlsKeyFile,
+		ServerName: *tlsServerName,
+		MinVersion: *tlsMinVersion,
+		Ciphers:    *tlsCiphers,
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading TLS settings", "err", err)
+		os.Exit(1)
+	}
+
+	if *commandConcurrency < 1 {
+		level.Error(logger).Log("msg", "Command concurrency must be at least 1", "concurrency", *commandConcurrency)
+		os.Exit(1)
+	}
+
+	if *limitPerTarget < 0 || *limitGlobal < 0 || *limitQueueSize < 0 {
+		level.Error(logger).Log("msg", "Connection limits and queue size can't be negative")
+		os.Exit(1)
+	}
+	limiter := newLimiter(*limitPerTarget, *limitGlobal, *limitQueueSize)
+	flights := newFlightGroup()
+	cache := newResultCache()
+	sched := newScheduler(limiter, logger)
+
+	prometheus.MustRegister(targetRejections, exportRequests, exportDuration, commandFailures, probesInFlight, openConnections)
+	prometheus.MustRegister(limitQueueWait, limitRejections, coalescedProbes)
+	for _, mode := range []string{connModePlain, tlsModeADH, tlsModeVerify, tlsModeInsecure} {
+		openConnections.WithLabelValues(mode)
+	}
+	sc := &SafeConfig{}
+	if *configFile != "" {
+		prometheus.MustRegister(configReloadSuccess, configReloadSeconds)
+		if err := sc.reload(*configFile); err != nil {
+			level.Error(logger).Log("msg", "Error loading config", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Loaded config file", "file", *configFile, "modules", len(sc.get().Modules))
+	}
+	sched.update(sc.get())
+
+	hup := make(chan os.Signal, 1)
+	reloadCh := make(chan chan error)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if err := reloadConfig(sc, sched, logger); err != nil {
+					level.Error(logger).Log("msg", "Error reloading config", "err", err)
+				}
+			case rc := <-reloadCh:
+				err := reloadConfig(sc, sched, logger)
+				if err != nil {
+					level.Error(logger).Log("msg", "Error reloading config", "err", err)
+				}
+				rc <- err
+			}
+		}
+	}()
+
 	level.Info(logger).Log("msg", "Listening on address", "address", *listenAddress)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -194,14 +807,28 @@ func main() {
             <body>
             <h1>NRPE Exporter</h1>
 						<p><a href="/metrics">Metrics</a></p>
+						<p><a href="/checks">Scheduled checks</a></p>
 						<p><a href="/export?command=check_load&target=127.0.0.1:5666">check_load against localhost:5666</a></p>
             </body>
             </html>`))
 	})
 
 	http.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
-		handler(w, r, logger)
+		handler(w, r, sc.get(), transports, limiter, flights, cache, logger)
+	})
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "This endpoint requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		rc := make(chan error)
+		reloadCh <- rc
+		if err := <-rc; err != nil {
+			http.Error(w, fmt.Sprintf("Failed to reload config: %s", err), http.StatusInternalServerError)
+		}
 	})
+	http.Handle("/checks", sched)
 	http.Handle("/metrics", promhttp.Handler())
 	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server")
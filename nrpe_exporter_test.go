@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestMain(m *testing.M) {
+	// Flags only get their defaults when parsed.
+	if _, err := kingpin.CommandLine.Parse(nil); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// export runs an /export request with the given query and headers against
+// config, and returns the response.
+func export(t *testing.T, config *Config, query string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	transports, err := sslTransports(TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/export?"+query, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler(w, r, config, transports, newLimiter(0, 0, 0), newFlightGroup(), newResultCache(), log.NewNopLogger())
+	return w
+}
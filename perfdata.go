@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	perfdataDescsByUnit = map[string]perfdataDescs{
+		"":        newPerfdataDescs(""),
+		"seconds": newPerfdataDescs("seconds"),
+		"bytes":   newPerfdataDescs("bytes"),
+		"ratio":   newPerfdataDescs("ratio"),
+	}
+	perfdataCounterDesc = prometheus.NewDesc("nrpe_perfdata_value_total",
+		"Value of a counter performance data item reported by the NRPE command",
+		[]string{"command", "label"}, nil)
+	perfdataThresholdInsideDesc = prometheus.NewDesc("nrpe_perfdata_threshold_inside",
+		"Whether the range alerts when the value is inside it (1, '@' prefix) rather than outside it (0)",
+		[]string{"command", "label", "bound"}, nil)
+
+	// baseUnits maps the units of measure from the plugin guidelines to the
+	// Prometheus base unit they are exported in, and the factor to get there.
+	baseUnits = map[string]struct {
+		unit   string
+		factor float64
+	}{
+		"s":  {"seconds", 1},
+		"ms": {"seconds", 1e-3},
+		"us": {"seconds", 1e-6},
+		"%":  {"ratio", 0.01},
+		"B":  {"bytes", 1},
+		"KB": {"bytes", 1 << 10},
+		"MB": {"bytes", 1 << 20},
+		"GB": {"bytes", 1 << 30},
+		"TB": {"bytes", 1 << 40},
+	}
+)
+
+// perfdataDescs are the descriptors for perfdata items in one base unit.
+type perfdataDescs struct {
+	value     *prometheus.Desc
+	threshold *prometheus.Desc
+	min       *prometheus.Desc
+	max       *prometheus.Desc
+}
+
+func newPerfdataDescs(unit string) perfdataDescs {
+	suffix := ""
+	if unit != "" {
+		suffix = "_" + unit
+	}
+	return perfdataDescs{
+		value: prometheus.NewDesc("nrpe_perfdata_value"+suffix,
+			"Value of a performance data item reported by the NRPE command",
+			[]string{"command", "label"}, nil),
+		threshold: prometheus.NewDesc("nrpe_perfdata_threshold"+suffix,
+			"Start or end of the warning or critical range of a performance data item",
+			[]string{"command", "label", "bound", "edge"}, nil),
+		min: prometheus.NewDesc("nrpe_perfdata_min"+suffix,
+			"Minimum possible value of a performance data item",
+			[]string{"command", "label"}, nil),
+		max: prometheus.NewDesc("nrpe_perfdata_max"+suffix,
+			"Maximum possible value of a performance data item",
+			[]string{"command", "label"}, nil),
+	}
+}
+
+// perfdatum is a single item of Nagios plugin performance data, in the form
+// 'label'=value[UOM];[warn];[crit];[min];[max]
+type perfdatum struct {
+	label string
+	value float64
+	uom   string
+	warn  *threshold
+	crit  *threshold
+	min   *float64
+	max   *float64
+
+	// Set by normalise.
+	unit    string
+	counter bool
+}
+
+// threshold is a Nagios plugin range. An alert is raised when the value lies
+// outside [start, end], or inside it if the range was prefixed with '@'.
+type threshold struct {
+	start  float64
+	end    float64
+	inside bool
+}
+
+// String formats the range in the plugin guidelines syntax.
+func (t *threshold) String() string {
+	if t == nil {
+		return ""
+	}
+	s := ""
+	if t.inside {
+		s = "@"
+	}
+	if math.IsInf(t.start, -1) {
+		s += "~:"
+	} else if t.start != 0 || math.IsInf(t.end, 1) {
+		s += strconv.FormatFloat(t.start, 'g', -1, 64) + ":"
+	}
+	if !math.IsInf(t.end, 1) {
+		s += strconv.FormatFloat(t.end, 'g', -1, 64)
+	}
+	return s
+}
+
+// scale multiplies both edges of the range by factor.
+func (t *threshold) scale(factor float64) {
+	if t == nil {
+		return
+	}
+	t.start *= factor
+	t.end *= factor
+}
+
+// normalise converts the item from its unit of measure to the matching
+// Prometheus base unit, and marks counters. Unknown units are left as is.
+func (p *perfdatum) normalise() {
+	if p.uom == "c" {
+		p.counter = true
+		return
+	}
+	u, ok := baseUnits[p.uom]
+	if !ok {
+		return
+	}
+	p.unit = u.unit
+	p.value *= u.factor
+	p.warn.scale(u.factor)
+	p.crit.scale(u.factor)
+	if p.min != nil {
+		min := *p.min * u.factor
+		p.min = &min
+	}
+	if p.max != nil {
+		max := *p.max * u.factor
+		p.max = &max
+	}
+}
+
+// metrics returns the series describing the perfdata item of command.
+func (p perfdatum) metrics(command string) []prometheus.Metric {
+	descs := perfdataDescsByUnit[p.unit]
+	value := prometheus.MustNewConstMetric(descs.value, prometheus.GaugeValue, p.value, command, p.label)
+	if p.counter {
+		value = prometheus.MustNewConstMetric(perfdataCounterDesc, prometheus.CounterValue, p.value, command, p.label)
+	}
+	metrics := []prometheus.Metric{value}
+	for _, b := range []struct {
+		bound string
+		t     *threshold
+	}{{"warning", p.warn}, {"critical", p.crit}} {
+		if b.t == nil {
+			continue
+		}
+		inside := 0.0
+		if b.t.inside {
+			inside = 1
+		}
+		metrics = append(metrics,
+			prometheus.MustNewConstMetric(descs.threshold, prometheus.GaugeValue, b.t.start, command, p.label, b.bound, "start"),
+			prometheus.MustNewConstMetric(descs.threshold, prometheus.GaugeValue, b.t.end, command, p.label, b.bound, "end"),
+			prometheus.MustNewConstMetric(perfdataThresholdInsideDesc, prometheus.GaugeValue, inside, command, p.label, b.bound),
+		)
+	}
+	if p.min != nil {
+		metrics = append(metrics, prometheus.MustNewConstMetric(descs.min, prometheus.GaugeValue, *p.min, command, p.label))
+	}
+	if p.max != nil {
+		metrics = append(metrics, prometheus.MustNewConstMetric(descs.max, prometheus.GaugeValue, *p.max, command, p.label))
+	}
+	return metrics
+}
+
+// splitOutput separates plugin output into its human readable text and its
+// performance data. Perfdata follows the first '|' on the first line, and on
+// subsequent lines everything after a '|' until the end of the output.
+func splitOutput(output string) (string, string) {
+	lines := strings.Split(output, "\n")
+	var text, perf []string
+
+	first := strings.SplitN(lines[0], "|", 2)
+	text = append(text, strings.TrimSpace(first[0]))
+	if len(first) == 2 {
+		perf = append(perf, first[1])
+	}
+
+	inPerf := false
+	for _, line := range lines[1:] {
+		if inPerf {
+			perf = append(perf, line)
+			continue
+		}
+		parts := strings.SplitN(line, "|", 2)
+		text = append(text, parts[0])
+		if len(parts) == 2 {
+			perf = append(perf, parts[1])
+			inPerf = true
+		}
+	}
+	return strings.TrimSpace(strings.Join(text, "\n")), strings.Join(perf, " ")
+}
+
+// parsePerfdata parses the perfdata section of plugin output. Items that are
+// malformed are skipped and reported in the returned errors, so one bad item
+// doesn't hide the rest.
+func parsePerfdata(perf string) ([]perfdatum, []error) {
+	var items []perfdatum
+	var errs []error
+
+	s := perf
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			break
+		}
+
+		label, rest, err := parseLabel(s)
+		if err != nil {
+			errs = append(errs, err)
+			// Resynchronise on the next item.
+			_, s = nextField(s)
+			continue
+		}
+		field, rest := nextField(rest)
+		s = rest
+		item, err := parseItem(label, field)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if item != nil {
+			items = append(items, *item)
+		}
+	}
+	return items, errs
+}
+
+// nextField splits s at the first whitespace.
+func nextField(s string) (string, string) {
+	end := strings.IndexAny(s, " \t\r\n")
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// parseLabel reads a perfdata label up to and including the '=' that ends it.
+// Labels containing spaces or '=' are single quoted, and a doubled single
+// quote inside them stands for a literal one.
+func parseLabel(s string) (string, string, error) {
+	if s[0] != '\'' {
+		i := strings.IndexAny(s, "= \t\r\n")
+		if i < 0 || s[i] != '=' {
+			return "", "", fmt.Errorf("perfdata item %q has no value", strings.Fields(s)[0])
+		}
+		if i == 0 {
+			return "", "", fmt.Errorf("empty perfdata label")
+		}
+		return s[:i], s[i+1:], nil
+	}
+
+	var label strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			label.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\'' {
+			label.WriteByte('\'')
+			i++
+			continue
+		}
+		if i+1 >= len(s) || s[i+1] != '=' {
+			return "", "", fmt.Errorf("perfdata label %q is not followed by '='", label.String())
+		}
+		if label.Len() == 0 {
+			return "", "", fmt.Errorf("empty perfdata label")
+		}
+		return label.String(), s[i+2:], nil
+	}
+	return "", "", fmt.Errorf("unterminated perfdata label %q", s)
+}
+
+// parseItem parses value[UOM];[warn];[crit];[min];[max] for the given label.
+// It returns nil without error for values the plugin reports as undetermined.
+func parseItem(label, s string) (*perfdatum, error) {
+	fields := strings.Split(s, ";")
+	if len(fields) > 5 {
+		return nil, fmt.Errorf("perfdata item %q has too many fields", label)
+	}
+	for len(fields) < 5 {
+		fields = append(fields, "")
+	}
+
+	if !utf8.ValidString(label) {
+		// Plugins running under a non-UTF-8 locale may print labels in
+		// other encodings, which Prometheus can't take as label values.
+		return nil, fmt.Errorf("perfdata label %q is not valid UTF-8", label)
+	}
+	if fields[0] == "U" {
+		return nil, nil
+	}
+	item := perfdatum{label: label}
+	var err error
+	if item.value, item.uom, err = parseValue(fields[0]); err != nil {
+		return nil, fmt.Errorf("perfdata item %q: %s", label, err)
+	}
+	if item.warn, err = parseRange(fields[1]); err != nil {
+		return nil, fmt.Errorf("perfdata item %q: warning %s", label, err)
+	}
+	if item.crit, err = parseRange(fields[2]); err != nil {
+		return nil, fmt.Errorf("perfdata item %q: critical %s", label, err)
+	}
+	if item.min, err = parseOptional(fields[3]); err != nil {
+		return nil, fmt.Errorf("perfdata item %q: minimum %s", label, err)
+	}
+	if item.max, err = parseOptional(fields[4]); err != nil {
+		return nil, fmt.Errorf("perfdata item %q: maximum %s", label, err)
+	}
+	return &item, nil
+}
+
+// parseRange parses a threshold in the Nagios range format [@]start:end,
+// where start defaults to 0, "~" as start means negative infinity, an empty
+// end means positive infinity and a bare number is the end of the range.
+func parseRange(s string) (*threshold, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t := threshold{end: math.Inf(1)}
+	r := s
+	if strings.HasPrefix(r, "@") {
+		t.inside = true
+		r = r[1:]
+	}
+
+	start, end := "", r
+	if i := strings.IndexByte(r, ':'); i >= 0 {
+		start, end = r[:i], r[i+1:]
+	}
+	var err error
+	switch start {
+	case "":
+	case "~":
+		t.start = math.Inf(-1)
+	default:
+		if t.start, err = parseNumber(start); err != nil {
+			return nil, fmt.Errorf("range %q has invalid start", s)
+		}
+	}
+	if end != "" {
+		if t.end, err = parseNumber(end); err != nil {
+			return nil, fmt.Errorf("range %q has invalid end", s)
+		}
+	} else if !strings.Contains(r, ":") {
+		return nil, fmt.Errorf("range %q is empty", s)
+	}
+	if t.start > t.end {
+		return nil, fmt.Errorf("range %q has start greater than end", s)
+	}
+	return &t, nil
+}
+
+// parseOptional parses a number from a field that may be left empty.
+func parseOptional(s string) (*float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v, err := parseNumber(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a number", s)
+	}
+	return &v, nil
+}
+
+// formatOptional formats a number parsed by parseOptional.
+func formatOptional(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'g', -1, 64)
+}
+
+// parseValue splits a number from its trailing unit of measure.
+func parseValue(s string) (float64, string, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789.,+-eE", r)
+	})
+	// An exponent marker belongs to the number only if digits follow it.
+	for i > 0 && (s[i-1] == 'e' || s[i-1] == 'E') {
+		i--
+	}
+	if i < 0 {
+		i = len(s)
+	}
+	num, uom := s[:i], s[i:]
+	value, err := parseNumber(num)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid value %q", s)
+	}
+	return value, uom, nil
+}
+
+// parseNumber parses a float, accepting the decimal comma some plugins emit
+// under non-English locales.
+func parseNumber(s string) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestParsePerfdata(t *testing.T) {
+	inf := math.Inf(1)
+	for _, tc := range []struct {
+		name  string
+		perf  string
+		items []perfdatum
+		errs  int
+	}{
+		{
+			name: "check_load",
+			perf: "load1=0.500;5.000;10.000;0; load5=0.400;4.000;6.000;0; load15=0.300;3.000;4.000;0;",
+			items: []perfdatum{
+				{label: "load1", value: 0.5, warn: &threshold{0, 5, false}, crit: &threshold{0, 10, false}, min: float(0)},
+				{label: "load5", value: 0.4, warn: &threshold{0, 4, false}, crit: &threshold{0, 6, false}, min: float(0)},
+				{label: "load15", value: 0.3, warn: &threshold{0, 3, false}, crit: &threshold{0, 4, false}, min: float(0)},
+			},
+		},
+		{
+			name:  "value only",
+			perf:  "users=3",
+			items: []perfdatum{{label: "users", value: 3}},
+		},
+		{
+			name:  "unit and all fields",
+			perf:  "time=250ms;500;1000;0;2000",
+			items: []perfdatum{{label: "time", value: 250, uom: "ms", warn: &threshold{0, 500, false}, crit: &threshold{0, 1000, false}, min: float(0), max: float(2000)}},
+		},
+		{
+			name: "quoted labels",
+			perf: "'/var/lib usage'=50% 'it''s=ok'=1 ''''=2",
+			items: []perfdatum{
+				{label: "/var/lib usage", value: 50, uom: "%"},
+				{label: "it's=ok", value: 1},
+				{label: "'", value: 2},
+			},
+		},
+		{
+			name:  "decimal comma",
+			perf:  "temp=21,5;30,5;40",
+			items: []perfdatum{{label: "temp", value: 21.5, warn: &threshold{0, 30.5, false}, crit: &threshold{0, 40, false}}},
+		},
+		{
+			name: "exponents",
+			perf: "a=1.5e-3s b=2E2 c=3ex",
+			items: []perfdatum{
+				{label: "a", value: 1.5e-3, uom: "s"},
+				{label: "b", value: 200},
+				{label: "c", value: 3, uom: "ex"},
+			},
+		},
+		{
+			name:  "undetermined",
+			perf:  "a=U b=1 c=U;1;2",
+			items: []perfdatum{{label: "b", value: 1}},
+		},
+		{
+			name: "ranges",
+			perf: "a=1;10:;~:20 b=1;@5:6;-1:1 c=1;~:;@0",
+			items: []perfdatum{
+				{label: "a", value: 1, warn: &threshold{10, inf, false}, crit: &threshold{math.Inf(-1), 20, false}},
+				{label: "b", value: 1, warn: &threshold{5, 6, true}, crit: &threshold{-1, 1, false}},
+				{label: "c", value: 1, warn: &threshold{math.Inf(-1), inf, false}, crit: &threshold{0, 0, true}},
+			},
+		},
+		{
+			name:  "surrounding whitespace",
+			perf:  "  a=1\t\r\nb=2  ",
+			items: []perfdatum{{label: "a", value: 1}, {label: "b", value: 2}},
+		},
+		{
+			name:  "empty",
+			perf:  "   ",
+			items: nil,
+		},
+		{
+			name:  "missing value resyncs",
+			perf:  "novalue ok=1",
+			items: []perfdatum{{label: "ok", value: 1}},
+			errs:  1,
+		},
+		{
+			name:  "empty labels",
+			perf:  "=1 ''=2 ok=3",
+			items: []perfdatum{{label: "ok", value: 3}},
+			errs:  2,
+		},
+		{
+			name:  "unterminated quoted label resyncs",
+			perf:  "'a b=1 c=2",
+			items: []perfdatum{{label: "b", value: 1}, {label: "c", value: 2}},
+			errs:  1,
+		},
+		{
+			name:  "quoted label without equals",
+			perf:  "'a'x=1 ok=2",
+			items: []perfdatum{{label: "ok", value: 2}},
+			errs:  1,
+		},
+		{
+			name:  "label not UTF-8",
+			perf:  "'/m\xe9dia'=5MB /var=2MB '/caf\xc3\xa9'=1MB",
+			items: []perfdatum{{label: "/var", value: 2, uom: "MB"}, {label: "/café", value: 1, uom: "MB"}},
+			errs:  1,
+		},
+		{
+			name: "malformed fields",
+			perf: "a=1;2;3;4;5;6 b=x c=1;5:2 d=1;x e=1;;y f=1;;;z g=1;;;;z h=1;@ ok=1",
+			items: []perfdatum{
+				{label: "ok", value: 1},
+			},
+			errs: 8,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			items, errs := parsePerfdata(tc.perf)
+			if !reflect.DeepEqual(items, tc.items) {
+				t.Errorf("parsePerfdata(%q) items:\n got %+v\nwant %+v", tc.perf, items, tc.items)
+			}
+			if len(errs) != tc.errs {
+				t.Errorf("parsePerfdata(%q) returned %d errors, want %d: %v", tc.perf, len(errs), tc.errs, errs)
+			}
+		})
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	for _, tc := range []struct {
+		in   perfdatum
+		want perfdatum
+	}{
+		{
+			in:   perfdatum{value: 250, uom: "ms", warn: &threshold{0, 500, false}, crit: &threshold{100, 1000, true}, min: float(0), max: float(2000)},
+			want: perfdatum{value: 0.25, uom: "ms", unit: "seconds", warn: &threshold{0, 0.5, false}, crit: &threshold{0.1, 1, true}, min: float(0), max: float(2)},
+		},
+		{
+			in:   perfdatum{value: 50, uom: "%", warn: &threshold{0, 80, false}, max: float(100)},
+			want: perfdatum{value: 0.5, uom: "%", unit: "ratio", warn: &threshold{0, 0.8, false}, max: float(1)},
+		},
+		{
+			in:   perfdatum{value: 2, uom: "KB"},
+			want: perfdatum{value: 2048, uom: "KB", unit: "bytes"},
+		},
+		{
+			in:   perfdatum{value: 1, uom: "GB", crit: &threshold{math.Inf(-1), math.Inf(1), false}},
+			want: perfdatum{value: 1 << 30, uom: "GB", unit: "bytes", crit: &threshold{math.Inf(-1), math.Inf(1), false}},
+		},
+		{
+			in:   perfdatum{value: 12345, uom: "c"},
+			want: perfdatum{value: 12345, uom: "c", counter: true},
+		},
+		{
+			in:   perfdatum{value: 7, uom: "widgets", min: float(1)},
+			want: perfdatum{value: 7, uom: "widgets", min: float(1)},
+		},
+	} {
+		got := tc.in
+		got.normalise()
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("normalise(%+v):\n got %+v\nwant %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSplitOutput(t *testing.T) {
+	for _, tc := range []struct {
+		output, text, perf string
+	}{
+		{"OK - all fine", "OK - all fine", ""},
+		{"OK - load|load1=0.5;5;10", "OK - load", "load1=0.5;5;10"},
+		{"DISK OK|/=2643MB;5948;5958\n/ 15272 MB (77%);\n/boot 68 MB (69%);|/boot=68MB;88;93\n/home=69357MB;253404;253464",
+			"DISK OK\n/ 15272 MB (77%);\n/boot 68 MB (69%);", "/=2643MB;5948;5958 /boot=68MB;88;93 /home=69357MB;253404;253464"},
+	} {
+		text, perf := splitOutput(tc.output)
+		if text != tc.text || perf != tc.perf {
+			t.Errorf("splitOutput(%q) = %q, %q, want %q, %q", tc.output, text, perf, tc.text, tc.perf)
+		}
+	}
+}
+
+func TestThresholdString(t *testing.T) {
+	for _, s := range []string{"10", "10:", "~:10", "5:6", "@5:6", "@~:", "-1:1", "0.5"} {
+		th, err := parseRange(s)
+		if err != nil {
+			t.Fatalf("parseRange(%q): %s", s, err)
+		}
+		if got := th.String(); got != s {
+			t.Errorf("parseRange(%q).String() = %q", s, got)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
+
+	nrpe "github.com/canonical/nrped/common"
+)
+
+const (
+	// nrpePacketVersion4 is the packet version of NRPE 4.x, which has the
+	// same layout as version 3 without its trailing padding.
+	nrpePacketVersion4 = 4
+
+	// protocolAuto tries the newest packet version first and falls back to
+	// older ones when the daemon rejects it.
+	protocolAuto = 0
+
+	// v3HeaderLength is the size of the fixed part of a v3/v4 packet:
+	// version, type, CRC32, result code, alignment and buffer length.
+	v3HeaderLength = 16
+	// v3Padding is the number of bytes a v3 packet carries after its buffer,
+	// an artifact of NRPE 3 sizing the packet with the padded C struct.
+	v3Padding = 3
+	// v2PacketLength is the size of a v2 packet. Shorter v3/v4 queries are
+	// padded to it so v2-only daemons read a full packet and reject it
+	// instead of waiting for more data.
+	v2PacketLength = 10 + nrpe.MAX_PACKETBUFFER_LENGTH + 2
+	// maxBufferLength is the largest v3/v4 buffer NRPE daemons accept.
+	maxBufferLength = 65536
+
+	// resultCodeMoreData is the result code of every packet but the last in
+	// a multi-packet v2 response. The final packet has the real result code.
+	resultCodeMoreData = 0x7fff
+	// maxResponsePackets bounds a multi-packet v2 response to the output
+	// size allowed in a v3/v4 packet.
+	maxResponsePackets = maxBufferLength / nrpe.MAX_PACKETBUFFER_LENGTH
+)
+
+// Reasons a response packet fails validation.
+const (
+	reasonCRCMismatch   = "crc_mismatch"
+	reasonBadPacketType = "bad_packet_type"
+	reasonBadVersion    = "bad_version"
+)
+
+var packetErrorReasons = []string{reasonCRCMismatch, reasonBadPacketType, reasonBadVersion}
+
+// packetError is returned for response packets that fail validation.
+type packetError struct {
+	reason string
+	msg    string
+}
+
+func (e *packetError) Error() string {
+	return e.msg
+}
+
+// versionRejectedError is returned when the daemon rejects the packet
+// version of a query, by closing the connection without answering or by
+// answering in another version.
+type versionRejectedError struct {
+	err error
+}
+
+func (e *versionRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *versionRejectedError) Unwrap() error {
+	return e.err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += n
+	return n, err
+}
+
+// packet is an NRPE packet of any protocol version.
+type packet struct {
+	version    int16
+	packetType int16
+	crc32      uint32
+	resultCode int16
+	buffer     []byte
+
+	// raw is the packet as read from the wire.
+	raw []byte
+}
+
+// output returns the NUL terminated string held in the packet buffer.
+func (p packet) output() string {
+	if i := bytes.IndexByte(p.buffer, 0); i >= 0 {
+		return string(p.buffer[:i])
+	}
+	return string(p.buffer)
+}
+
+// logFields returns the header fields of the packet as key/value pairs for
+// logging.
+func (p packet) logFields() []interface{} {
+	return []interface{}{
+		"packet_version", p.version,
+		"packet_type", p.packetType,
+		"crc32", fmt.Sprintf("%08x", p.crc32),
+		"result_code", p.resultCode,
+		"buffer_length", len(p.buffer),
+	}
+}
+
+// validate checks the packet is an intact response of the given version.
+func (p packet) validate(version int16) error {
+	raw := append([]byte(nil), p.raw...)
+	binary.BigEndian.PutUint32(raw[4:], 0)
+	if crc := crc32.ChecksumIEEE(raw); crc != p.crc32 {
+		return &packetError{reasonCRCMismatch, fmt.Sprintf("packet CRC32 is %08x, expected %08x", p.crc32, crc)}
+	}
+	if p.packetType != nrpe.RESPONSE_PACKET {
+		return &packetError{reasonBadPacketType, fmt.Sprintf("packet type is %d, expected a response", p.packetType)}
+	}
+	if p.version != version {
+		return &packetError{reasonBadVersion, fmt.Sprintf("response has packet version %d, query had %d", p.version, version)}
+	}
+	return nil
+}
+
+// parseProtocol parses the protocol query parameter, defaulting to v2.
+func parseProtocol(s string) (int16, error) {
+	switch s {
+	case "", "2":
+		return nrpe.NRPE_PACKET_VERSION_2, nil
+	case "3":
+		return nrpe.NRPE_PACKET_VERSION_3, nil
+	case "4":
+		return nrpePacketVersion4, nil
+	case "auto":
+		return protocolAuto, nil
+	}
+	return 0, fmt.Errorf("unsupported protocol version %q", s)
+}
+
+// joinCommand encodes a command and its arguments the way check_nrpe -a does,
+// as command!arg1!arg2. The daemon substitutes the arguments for $ARGn$ in the
+// command definition when dont_blame_nrpe is enabled.
+func joinCommand(cmd string, args []string) (string, error) {
+	// The command name labels its metrics.
+	if !utf8.ValidString(cmd) {
+		return "", fmt.Errorf("command %q is not valid UTF-8", cmd)
+	}
+	if strings.IndexFunc(cmd, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("command %q contains a control character", cmd)
+	}
+	if len(args) == 0 {
+		return cmd, nil
+	}
+	if strings.Contains(cmd, "!") {
+		return "", fmt.Errorf("command %q must not contain '!' when arguments are given", cmd)
+	}
+	for i, arg := range args {
+		if strings.Contains(arg, "!") {
+			return "", fmt.Errorf("argument %d contains '!'", i+1)
+		}
+		if strings.IndexFunc(arg, unicode.IsControl) >= 0 {
+			return "", fmt.Errorf("argument %d contains a control character", i+1)
+		}
+	}
+	return cmd + "!" + strings.Join(args, "!"), nil
+}
+
+// sendQuery sends cmd to the daemon in a query packet of the given version,
+// and returns the packet sent.
+func sendQuery(conn net.Conn, version int16, cmd string) (packet, error) {
+	if version == nrpe.NRPE_PACKET_VERSION_2 {
+		if len(cmd) >= nrpe.MAX_PACKETBUFFER_LENGTH {
+			return packet{}, fmt.Errorf("command is %d bytes, v2 packets are limited to %d", len(cmd), nrpe.MAX_PACKETBUFFER_LENGTH-1)
+		}
+		query := nrpe.PrepareToSend(cmd, nrpe.QUERY_PACKET)
+		return packet{
+			version:    query.PacketVersion,
+			packetType: query.PacketType,
+			crc32:      query.CRC32Value,
+			resultCode: query.ResultCode,
+			buffer:     query.CommandBuffer[:],
+			raw:        query.Encode(),
+		}, nrpe.SendPacket(conn, query)
+	}
+
+	if len(cmd) >= maxBufferLength {
+		return packet{}, fmt.Errorf("command is %d bytes, v%d packets are limited to %d", len(cmd), version, maxBufferLength-1)
+	}
+	headerLength := v3HeaderLength
+	if version == nrpe.NRPE_PACKET_VERSION_3 {
+		headerLength += v3Padding
+	}
+	bufferLength := len(cmd) + 1
+	if headerLength+bufferLength < v2PacketLength {
+		bufferLength = v2PacketLength - headerLength
+	}
+
+	pkt := make([]byte, headerLength+bufferLength)
+	binary.BigEndian.PutUint16(pkt[0:], uint16(version))
+	binary.BigEndian.PutUint16(pkt[2:], nrpe.QUERY_PACKET)
+	binary.BigEndian.PutUint16(pkt[8:], nrpe.STATE_UNKNOWN)
+	binary.BigEndian.PutUint32(pkt[12:], uint32(bufferLength))
+	copy(pkt[v3HeaderLength:], cmd)
+	crc := crc32.ChecksumIEEE(pkt)
+	binary.BigEndian.PutUint32(pkt[4:], crc)
+
+	_, err := conn.Write(pkt)
+	return packet{
+		version:    version,
+		packetType: nrpe.QUERY_PACKET,
+		crc32:      crc,
+		resultCode: nrpe.STATE_UNKNOWN,
+		buffer:     pkt[v3HeaderLength : v3HeaderLength+bufferLength],
+		raw:        pkt,
+	}, err
+}
+
+// readPacket reads a single packet of any version from r.
+func readPacket(r io.Reader) (packet, error) {
+	var header [10]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return packet{}, err
+	}
+	pkt := packet{
+		version:    int16(binary.BigEndian.Uint16(header[0:])),
+		packetType: int16(binary.BigEndian.Uint16(header[2:])),
+		crc32:      binary.BigEndian.Uint32(header[4:]),
+		resultCode: int16(binary.BigEndian.Uint16(header[8:])),
+	}
+
+	switch pkt.version {
+	case nrpe.NRPE_PACKET_VERSION_2:
+		// Buffer and trailer.
+		rest := make([]byte, nrpe.MAX_PACKETBUFFER_LENGTH+2)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return pkt, err
+		}
+		pkt.buffer = rest[:nrpe.MAX_PACKETBUFFER_LENGTH]
+		pkt.raw = append(header[:], rest...)
+	case nrpe.NRPE_PACKET_VERSION_3, nrpePacketVersion4:
+		// Alignment and buffer length.
+		var sizes [6]byte
+		if _, err := io.ReadFull(r, sizes[:]); err != nil {
+			return pkt, err
+		}
+		length := int32(binary.BigEndian.Uint32(sizes[2:]))
+		if length < 0 || length > maxBufferLength {
+			return pkt, fmt.Errorf("invalid buffer length %d in v%d packet", length, pkt.version)
+		}
+		padding := 0
+		if pkt.version == nrpe.NRPE_PACKET_VERSION_3 {
+			padding = v3Padding
+		}
+		rest := make([]byte, int(length)+padding)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return pkt, err
+		}
+		pkt.buffer = rest[:length]
+		pkt.raw = append(append(header[:], sizes[:]...), rest...)
+	default:
+		return pkt, &packetError{reasonBadVersion, fmt.Sprintf("unknown packet version %d", pkt.version)}
+	}
+	return pkt, nil
+}
+
+// readResponse reads a response to a query of the given version from r,
+// validating each packet and reassembling v2 output that the daemon split
+// over several packets. The returned packet holds the combined output and the
+// result code of the final packet, and is returned along with the number of
+// packets read. Errors showing the daemon doesn't speak the version are
+// returned as a versionRejectedError.
+func readResponse(r io.Reader, version int16) (packet, int, error) {
+	counter := &countingReader{r: r}
+	pkt, err := readPacket(counter)
+	if err == nil {
+		err = pkt.validate(version)
+	}
+	var pktErr *packetError
+	if errors.As(err, &pktErr) && pktErr.reason == reasonBadVersion ||
+		counter.n == 0 && (errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)) {
+		err = &versionRejectedError{err}
+	}
+	if err != nil {
+		return pkt, 1, err
+	}
+	if pkt.version != nrpe.NRPE_PACKET_VERSION_2 || pkt.resultCode != resultCodeMoreData {
+		return pkt, 1, nil
+	}
+
+	output := []byte(pkt.output())
+	for count := 2; ; count++ {
+		if count > maxResponsePackets {
+			return pkt, count - 1, fmt.Errorf("response exceeds %d packets", maxResponsePackets)
+		}
+		next, err := readPacket(r)
+		if err == nil {
+			err = next.validate(version)
+		}
+		if err != nil {
+			return pkt, count, fmt.Errorf("error reading packet %d of response: %w", count, err)
+		}
+		output = append(output, next.output()...)
+		if next.resultCode != resultCodeMoreData {
+			next.buffer = output
+			return next, count, nil
+		}
+	}
+}
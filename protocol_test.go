@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	nrpe "github.com/canonical/nrped/common"
+)
+
+// v2Packet builds a v2 packet holding output.
+func v2Packet(packetType, resultCode int16, output string) []byte {
+	pkt := make([]byte, v2PacketLength)
+	binary.BigEndian.PutUint16(pkt[0:], uint16(nrpe.NRPE_PACKET_VERSION_2))
+	binary.BigEndian.PutUint16(pkt[2:], uint16(packetType))
+	binary.BigEndian.PutUint16(pkt[8:], uint16(resultCode))
+	copy(pkt[10:10+nrpe.MAX_PACKETBUFFER_LENGTH-1], output)
+	binary.BigEndian.PutUint32(pkt[4:], crc32.ChecksumIEEE(pkt))
+	return pkt
+}
+
+// v3Packet builds a v3 or v4 packet holding output, with the padding of v3.
+func v3Packet(version, packetType, resultCode int16, output string) []byte {
+	length := len(output) + 1
+	padding := 0
+	if version == nrpe.NRPE_PACKET_VERSION_3 {
+		padding = v3Padding
+	}
+	pkt := make([]byte, v3HeaderLength+length+padding)
+	binary.BigEndian.PutUint16(pkt[0:], uint16(version))
+	binary.BigEndian.PutUint16(pkt[2:], uint16(packetType))
+	binary.BigEndian.PutUint16(pkt[8:], uint16(resultCode))
+	binary.BigEndian.PutUint32(pkt[12:], uint32(length))
+	copy(pkt[v3HeaderLength:], output)
+	binary.BigEndian.PutUint32(pkt[4:], crc32.ChecksumIEEE(pkt))
+	return pkt
+}
+
+func concat(pkts ...[]byte) []byte {
+	return bytes.Join(pkts, nil)
+}
+
+func TestReadResponse(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+	for _, tc := range []struct {
+		name       string
+		data       []byte
+		version    int16
+		output     string
+		resultCode int16
+		packets    int
+	}{
+		{"v2", v2Packet(nrpe.RESPONSE_PACKET, 1, "WARNING - load"), nrpe.NRPE_PACKET_VERSION_2, "WARNING - load", 1, 1},
+		{"v3", v3Packet(nrpe.NRPE_PACKET_VERSION_3, nrpe.RESPONSE_PACKET, 0, long), nrpe.NRPE_PACKET_VERSION_3, long, 0, 1},
+		{"v4", v3Packet(nrpePacketVersion4, nrpe.RESPONSE_PACKET, 2, long), nrpePacketVersion4, long, 2, 1},
+		{"v2 multi-packet",
+			concat(
+				v2Packet(nrpe.RESPONSE_PACKET, resultCodeMoreData, strings.Repeat("a", 1023)),
+				v2Packet(nrpe.RESPONSE_PACKET, resultCodeMoreData, strings.Repeat("b", 1023)),
+				v2Packet(nrpe.RESPONSE_PACKET, 2, "end"),
+			),
+			nrpe.NRPE_PACKET_VERSION_2, strings.Repeat("a", 1023) + strings.Repeat("b", 1023) + "end", 2, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bytes.NewReader(tc.data)
+			pkt, packets, err := readResponse(r, tc.version)
+			if err != nil {
+				t.Fatalf("readResponse: %s", err)
+			}
+			if pkt.output() != tc.output {
+				t.Errorf("output is %q, want %q", pkt.output(), tc.output)
+			}
+			if pkt.resultCode != tc.resultCode {
+				t.Errorf("result code is %d, want %d", pkt.resultCode, tc.resultCode)
+			}
+			if packets != tc.packets {
+				t.Errorf("read %d packets, want %d", packets, tc.packets)
+			}
+			if r.Len() != 0 {
+				t.Errorf("%d bytes left unread", r.Len())
+			}
+		})
+	}
+}
+
+func TestReadResponseErrors(t *testing.T) {
+	badCRC := v2Packet(nrpe.RESPONSE_PACKET, 0, "OK")
+	badCRC[4] ^= 0xff
+	badLength := v3Packet(nrpePacketVersion4, nrpe.RESPONSE_PACKET, 0, "OK")
+	binary.BigEndian.PutUint32(badLength[12:], maxBufferLength+1)
+	var tooMany [][]byte
+	for i := 0; i <= maxResponsePackets; i++ {
+		tooMany = append(tooMany, v2Packet(nrpe.RESPONSE_PACKET, resultCodeMoreData, "more"))
+	}
+	unknownVersion := v2Packet(nrpe.RESPONSE_PACKET, 0, "OK")
+	unknownVersion[1] = 9
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		version  int16
+		reason   string
+		rejected bool
+	}{
+		{"crc mismatch", badCRC, nrpe.NRPE_PACKET_VERSION_2, reasonCRCMismatch, false},
+		{"query packet", v2Packet(nrpe.QUERY_PACKET, 0, "OK"), nrpe.NRPE_PACKET_VERSION_2, reasonBadPacketType, false},
+		{"other version", v2Packet(nrpe.RESPONSE_PACKET, 0, "OK"), nrpe.NRPE_PACKET_VERSION_3, reasonBadVersion, true},
+		{"unknown version", unknownVersion, nrpe.NRPE_PACKET_VERSION_2, reasonBadVersion, true},
+		{"crc mismatch in later packet",
+			concat(v2Packet(nrpe.RESPONSE_PACKET, resultCodeMoreData, "more"), badCRC),
+			nrpe.NRPE_PACKET_VERSION_2, reasonCRCMismatch, false},
+		{"version change in later packet",
+			concat(v2Packet(nrpe.RESPONSE_PACKET, resultCodeMoreData, "more"), v3Packet(nrpe.NRPE_PACKET_VERSION_3, nrpe.RESPONSE_PACKET, 0, "OK")),
+			nrpe.NRPE_PACKET_VERSION_2, reasonBadVersion, false},
+		{"invalid buffer length", badLength, nrpePacketVersion4, "", false},
+		{"too many packets", concat(tooMany...), nrpe.NRPE_PACKET_VERSION_2, "", false},
+		{"truncated packet", v2Packet(nrpe.RESPONSE_PACKET, 0, "OK")[:100], nrpe.NRPE_PACKET_VERSION_2, "", false},
+		{"no answer", nil, nrpePacketVersion4, "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := readResponse(bytes.NewReader(tc.data), tc.version)
+			if err == nil {
+				t.Fatal("readResponse succeeded")
+			}
+			var pktErr *packetError
+			reason := ""
+			if errors.As(err, &pktErr) {
+				reason = pktErr.reason
+			}
+			if reason != tc.reason {
+				t.Errorf("packet error reason of %q is %q, want %q", err, reason, tc.reason)
+			}
+			var rejected *versionRejectedError
+			if errors.As(err, &rejected) != tc.rejected {
+				t.Errorf("version rejected is %t for %q, want %t", !tc.rejected, err, tc.rejected)
+			}
+		})
+	}
+}
+
+func TestReadResponseLimit(t *testing.T) {
+	var pkts [][]byte
+	for i := 1; i < maxResponsePackets; i++ {
+		pkts = append(pkts, v2Packet(nrpe.RESPONSE_PACKET, resultCodeMoreData, "x"))
+	}
+	pkts = append(pkts, v2Packet(nrpe.RESPONSE_PACKET, 0, "x"))
+	pkt, packets, err := readResponse(bytes.NewReader(concat(pkts...)), nrpe.NRPE_PACKET_VERSION_2)
+	if err != nil {
+		t.Fatalf("readResponse of %d packets: %s", maxResponsePackets, err)
+	}
+	if packets != maxResponsePackets || pkt.output() != strings.Repeat("x", maxResponsePackets) {
+		t.Errorf("read %d packets with output %q", packets, pkt.output())
+	}
+}
+
+// resetReader fails like a connection reset by the peer after n bytes.
+type resetReader struct {
+	r io.Reader
+}
+
+func (r resetReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err == io.EOF {
+		err = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	return n, err
+}
+
+func TestReadResponseReset(t *testing.T) {
+	_, _, err := readResponse(resetReader{bytes.NewReader(nil)}, nrpePacketVersion4)
+	var rejected *versionRejectedError
+	if !errors.As(err, &rejected) {
+		t.Errorf("reset before answering gave %v, want a rejected version", err)
+	}
+	partial := v2Packet(nrpe.RESPONSE_PACKET, 0, "OK")[:6]
+	_, _, err = readResponse(resetReader{bytes.NewReader(partial)}, nrpe.NRPE_PACKET_VERSION_2)
+	if err == nil || errors.As(err, &rejected) {
+		t.Errorf("reset after answering gave %v, want another error", err)
+	}
+}
+
+// writeConn records what is written to it.
+type writeConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *writeConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func TestSendQuery(t *testing.T) {
+	long := strings.Repeat("y", 2000)
+	for _, tc := range []struct {
+		version int16
+		cmd     string
+		length  int
+	}{
+		{nrpe.NRPE_PACKET_VERSION_2, "check_load", v2PacketLength},
+		{nrpe.NRPE_PACKET_VERSION_3, "check_load", v2PacketLength},
+		{nrpePacketVersion4, "check_load", v2PacketLength},
+		{nrpe.NRPE_PACKET_VERSION_3, long, v3HeaderLength + len(long) + 1 + v3Padding},
+		{nrpePacketVersion4, long, v3HeaderLength + len(long) + 1},
+	} {
+		conn := &writeConn{}
+		sent, err := sendQuery(conn, tc.version, tc.cmd)
+		if err != nil {
+			t.Fatalf("sendQuery v%d: %s", tc.version, err)
+		}
+		raw := conn.buf.Bytes()
+		if len(raw) != tc.length || !bytes.Equal(raw, sent.raw) {
+			t.Errorf("v%d query of %d bytes is %d bytes, want %d", tc.version, len(tc.cmd), len(raw), tc.length)
+		}
+		pkt, err := readPacket(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("reading v%d query: %s", tc.version, err)
+		}
+		if pkt.version != tc.version || pkt.packetType != nrpe.QUERY_PACKET || pkt.output() != tc.cmd {
+			t.Errorf("v%d query decoded as version %d, type %d, command %q", tc.version, pkt.version, pkt.packetType, pkt.output())
+		}
+		check := append([]byte(nil), raw...)
+		binary.BigEndian.PutUint32(check[4:], 0)
+		if crc := crc32.ChecksumIEEE(check); crc != pkt.crc32 {
+			t.Errorf("v%d query CRC32 is %08x, want %08x", tc.version, pkt.crc32, crc)
+		}
+	}
+
+	for _, tc := range []struct {
+		version int16
+		length  int
+	}{
+		{nrpe.NRPE_PACKET_VERSION_2, nrpe.MAX_PACKETBUFFER_LENGTH},
+		{nrpePacketVersion4, maxBufferLength},
+	} {
+		if _, err := sendQuery(&writeConn{}, tc.version, strings.Repeat("z", tc.length)); err == nil {
+			t.Errorf("sendQuery v%d accepted a %d byte command", tc.version, tc.length)
+		}
+	}
+}
+
+func TestJoinCommand(t *testing.T) {
+	for _, tc := range []struct {
+		cmd   string
+		args  []string
+		query string
+		err   bool
+	}{
+		{cmd: "check_load", query: "check_load"},
+		{cmd: "check_disk", args: []string{"/", "-w 10%"}, query: "check_disk!/!-w 10%"},
+		{cmd: "check_disk", args: []string{""}, query: "check_disk!"},
+		// Without arguments the command is sent as given.
+		{cmd: "check_disk!/", query: "check_disk!/"},
+		{cmd: "check_disk!/", args: []string{"/var"}, err: true},
+		{cmd: "check_disk", args: []string{"/!/var"}, err: true},
+		{cmd: "check_disk", args: []string{"/", "/var\nfoo"}, err: true},
+		{cmd: "check_disk", args: []string{"/\x00"}, err: true},
+		{cmd: "check_disk", args: []string{"\x7f"}, err: true},
+		{cmd: "check_disk", args: []string{"/m\u00e9dia"}, query: "check_disk!/m\u00e9dia"},
+		{cmd: "check_\xff", err: true},
+		{cmd: "check_load\n", err: true},
+		{cmd: "check_load\x00", args: []string{"1"}, err: true},
+	} {
+		query, err := joinCommand(tc.cmd, tc.args)
+		if tc.err {
+			if err == nil {
+				t.Errorf("joinCommand(%q, %q) = %q, want an error", tc.cmd, tc.args, query)
+			}
+			continue
+		}
+		if err != nil || query != tc.query {
+			t.Errorf("joinCommand(%q, %q) = %q, %v, want %q", tc.cmd, tc.args, query, err, tc.query)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scheduleJitter is the fraction of the interval by which each run is moved
+// at random, so that checks started together drift apart.
+const scheduleJitter = 0.1
+
+var lastRunDesc = prometheus.NewDesc("nrpe_check_last_run_timestamp_seconds", "Time the scheduled check last finished running, in seconds since the epoch", nil, nil)
+
+// scheduler runs the checks of the configuration in the background, and
+// serves their latest results.
+type scheduler struct {
+	limiter *limiter
+	logger  log.Logger
+
+	mu       sync.Mutex
+	jobs     map[string]*scheduledJob
+	registry *prometheus.Registry
+	// rand is seeded, so that restarts and replicas spread the checks
+	// differently. math/rand isn't seeded by default before Go 1.20.
+	rand *rand.Rand
+}
+
+func newScheduler(limiter *limiter, logger log.Logger) *scheduler {
+	return &scheduler{
+		limiter:  limiter,
+		logger:   logger,
+		jobs:     make(map[string]*scheduledJob),
+		registry: prometheus.NewRegistry(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// update replaces the running checks with those of config. Checks of the
+// same module and target keep running on their schedule, with any changed
+// settings taking effect from their next run. Their results are kept until
+// then if the commands are the same.
+func (s *scheduler) update(config *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make(map[string]*scheduledJob)
+	registry := prometheus.NewRegistry()
+	for _, check := range config.Checks {
+		module := config.Modules[check.Module]
+		var commands []nrpeCommand
+		for _, c := range module.commandList() {
+			// Validated when the configuration was loaded.
+			query, _ := joinCommand(c.Command, c.Args)
+			commands = append(commands, nrpeCommand{name: c.Command, query: query})
+		}
+		settings := jobSettings{module: module, commands: commands, interval: check.Interval}
+
+		for _, target := range check.Targets {
+			key := check.Module + "\x00" + target
+			job, ok := s.jobs[key]
+			if ok {
+				job.reconfigure(settings)
+			} else {
+				ctx, cancel := context.WithCancel(context.Background())
+				job = &scheduledJob{
+					target:   target,
+					limiter:  s.limiter,
+					logger:   log.With(s.logger, "target", target, "module", check.Module),
+					stop:     cancel,
+					changed:  make(chan struct{}, 1),
+					rand:     rand.New(rand.NewSource(s.rand.Int63())),
+					settings: settings,
+				}
+				// Spread the checks over the interval rather than run them
+				// all at once.
+				offset := time.Duration(s.rand.Int63n(int64(check.Interval)))
+				go job.loop(ctx, offset)
+			}
+			jobs[key] = job
+			prometheus.WrapRegistererWith(prometheus.Labels{"target": target, "module": check.Module}, registry).MustRegister(job)
+		}
+	}
+	for key, job := range s.jobs {
+		if _, ok := jobs[key]; !ok {
+			job.stop()
+		}
+	}
+	s.jobs = jobs
+	s.registry = registry
+	if len(jobs) > 0 {
+		level.Info(s.logger).Log("msg", "Scheduled checks", "targets", len(jobs))
+	}
+}
+
+// ServeHTTP serves the latest results of the checks.
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	registry := s.registry
+	s.mu.Unlock()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// jobSettings are what a scheduled job runs, which a reload may change.
+type jobSettings struct {
+	module   Module
+	commands []nrpeCommand
+	interval time.Duration
+}
+
+// scheduledJob runs the commands of a check against one target, and exports
+// the results of the last run.
+type scheduledJob struct {
+	target  string
+	limiter *limiter
+	logger  log.Logger
+	stop    context.CancelFunc
+	// changed wakes the loop when the interval changes.
+	changed chan struct{}
+	// rand is only used by the loop.
+	rand *rand.Rand
+
+	mu        sync.Mutex
+	settings  jobSettings
+	collector *Collector
+	lastRun   time.Time
+	// generation counts the changes of commands, so that runs started
+	// before one don't store their results.
+	generation int
+}
+
+// reconfigure makes the job run with settings from its next run on. The
+// results of the last run are dropped unless the commands are the same.
+func (j *scheduledJob) reconfigure(settings jobSettings) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !sameCommands(j.settings.commands, settings.commands) {
+		j.collector, j.lastRun = nil, time.Time{}
+		j.generation++
+	}
+	if settings.interval != j.settings.interval {
+		select {
+		case j.changed <- struct{}{}:
+		default:
+		}
+	}
+	j.settings = settings
+}
+
+func sameCommands(a, b []nrpeCommand) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// loop runs the job every interval, give or take the jitter, after offset,
+// until ctx is done.
+func (j *scheduledJob) loop(ctx context.Context, offset time.Duration) {
+	timer := time.NewTimer(offset)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.changed:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(j.untilNext())
+			continue
+		case <-timer.C:
+		}
+		j.run(ctx)
+		timer.Reset(j.untilNext())
+	}
+}
+
+// untilNext returns the time until the next run, an interval after the last
+// one give or take the jitter, or at a random offset within the interval if
+// there is none.
+func (j *scheduledJob) untilNext() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	interval := j.settings.interval
+	if j.lastRun.IsZero() {
+		return time.Duration(j.rand.Int63n(int64(interval)))
+	}
+	jitter := time.Duration((2*j.rand.Float64() - 1) * scheduleJitter * float64(interval))
+	next := time.Until(j.lastRun.Add(interval + jitter))
+	if next < 0 {
+		return 0
+	}
+	return next
+}
+
+// run runs the commands once, within the module timeout or the interval.
+func (j *scheduledJob) run(ctx context.Context) {
+	j.mu.Lock()
+	settings, generation := j.settings, j.generation
+	j.mu.Unlock()
+
+	timeout := settings.interval
+	if settings.module.Timeout > 0 && settings.module.Timeout < timeout {
+		timeout = settings.module.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	collector := NewCollector(ctx, settings.commands, j.target, j.target, settings.module, j.limiter, j.logger)
+	collector.reportAge = true
+	collector.run()
+	if ctx.Err() == context.Canceled {
+		// Removed by a reload.
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.generation != generation {
+		// The commands changed while running.
+		return
+	}
+	j.collector = collector
+	j.lastRun = time.Now()
+}
+
+func (j *scheduledJob) Describe(ch chan<- *prometheus.Desc) {
+	(&Collector{}).Describe(ch)
+	ch <- lastRunDesc
+}
+
+func (j *scheduledJob) Collect(ch chan<- prometheus.Metric) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.collector == nil {
+		return
+	}
+	j.collector.collectResults(ch)
+	ch <- prometheus.MustNewConstMetric(lastRunDesc, prometheus.GaugeValue, float64(j.lastRun.UnixNano())/1e9)
+}
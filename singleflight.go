@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var coalescedProbes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "nrpe_exporter_coalesced_probes_total",
+	Help: "Number of commands that shared the result of an identical command already in flight instead of running.",
+})
+
+// flight is a command in flight, whose result is shared by identical ones.
+type flight struct {
+	done   chan struct{}
+	result CommandResult
+	err    error
+	// abandoned is set if the context of the call that ran the command was
+	// done when it returned, so its error may only concern that call.
+	abandoned bool
+	// joined is the number of calls that waited for the result. It is
+	// guarded by the group's mutex.
+	joined int
+}
+
+// flightGroup runs identical commands only once at a time, in the manner of
+// golang.org/x/sync/singleflight.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do runs fn, which must stop once ctx is done, unless a call with the same
+// key is in flight, in which case it waits for its result until ctx is done.
+// If that call fails because its own context was done first, fn runs in its
+// place. The result must not be modified, as it may be shared.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (CommandResult, error)) (CommandResult, error) {
+	g.mu.Lock()
+	for {
+		f, ok := g.flights[key]
+		if !ok {
+			break
+		}
+		f.joined++
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return CommandResult{}, ctx.Err()
+		}
+		if f.err == nil || !f.abandoned || ctx.Err() != nil {
+			// Only calls given the result count as coalesced.
+			coalescedProbes.Inc()
+			return f.result, f.err
+		}
+		g.mu.Lock()
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.result, f.err = fn()
+	f.abandoned = ctx.Err() != nil
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.result, f.err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// waitJoined waits until the flight of key started and n calls joined it.
+func waitJoined(t *testing.T, g *flightGroup, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.mu.Lock()
+		joined := -1
+		if f, ok := g.flights[key]; ok {
+			joined = f.joined
+		}
+		g.mu.Unlock()
+		if joined >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("calls didn't join the flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func coalescedCount() float64 {
+	var m dto.Metric
+	coalescedProbes.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+type flightResult struct {
+	result CommandResult
+	err    error
+}
+
+func TestFlightGroupShares(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	runs := 0
+	fn := func() (CommandResult, error) {
+		runs++
+		<-release
+		return CommandResult{statusOk: 1}, nil
+	}
+
+	before := coalescedCount()
+	results := make(chan flightResult, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			result, err := g.do(context.Background(), "key", fn)
+			results <- flightResult{result, err}
+		}()
+		if i == 0 {
+			// Let the first call start the flight.
+			waitJoined(t, g, "key", 0)
+		}
+	}
+	waitJoined(t, g, "key", 2)
+	close(release)
+	for i := 0; i < 3; i++ {
+		r := <-results
+		if r.err != nil || r.result.statusOk != 1 {
+			t.Errorf("call returned %+v, %v", r.result, r.err)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("command ran %d times, want 1", runs)
+	}
+	if n := coalescedCount() - before; n != 2 {
+		t.Errorf("%g calls counted as coalesced, want 2", n)
+	}
+}
+
+// TestFlightGroupCancelledCaller checks that a call cancelled while others
+// wait for its result doesn't fail them.
+func TestFlightGroupCancelledCaller(t *testing.T) {
+	g := newFlightGroup()
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	first := make(chan error, 1)
+	go func() {
+		_, err := g.do(firstCtx, "key", func() (CommandResult, error) {
+			// A daemon that never answers.
+			close(started)
+			<-firstCtx.Done()
+			return CommandResult{}, firstCtx.Err()
+		})
+		first <- err
+	}()
+	<-started
+
+	before := coalescedCount()
+	second := make(chan flightResult, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result, err := g.do(ctx, "key", func() (CommandResult, error) {
+			return CommandResult{statusOk: 1}, nil
+		})
+		second <- flightResult{result, err}
+	}()
+	waitJoined(t, g, "key", 1)
+	cancelFirst()
+
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled call returned %v", err)
+	}
+	r := <-second
+	if r.err != nil || r.result.statusOk != 1 {
+		t.Errorf("waiting call returned %+v, %v, want its own result", r.result, r.err)
+	}
+	if n := coalescedCount() - before; n != 0 {
+		t.Errorf("%g calls counted as coalesced, want 0", n)
+	}
+}
+
+// TestFlightGroupWaiterTimeout checks that a call whose context is done
+// while it waits returns without a result.
+func TestFlightGroupWaiterTimeout(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	first := make(chan error, 1)
+	go func() {
+		_, err := g.do(context.Background(), "key", func() (CommandResult, error) {
+			close(started)
+			<-release
+			return CommandResult{statusOk: 1}, nil
+		})
+		first <- err
+	}()
+	<-started
+
+	before := coalescedCount()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := g.do(ctx, "key", func() (CommandResult, error) {
+		t.Error("command ran again")
+		return CommandResult{}, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting call returned %v", err)
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("first call returned %v", err)
+	}
+	if n := coalescedCount() - before; n != 0 {
+		t.Errorf("%g calls counted as coalesced, want 0", n)
+	}
+}
+
+// TestFlightGroupSharesFailures checks that failures not caused by the
+// caller going away are shared rather than retried.
+func TestFlightGroupSharesFailures(t *testing.T) {
+	g := newFlightGroup()
+	failure := errors.New("connection refused")
+	release := make(chan struct{})
+	started := make(chan struct{})
+	first := make(chan error, 1)
+	go func() {
+		_, err := g.do(context.Background(), "key", func() (CommandResult, error) {
+			close(started)
+			<-release
+			return CommandResult{}, failure
+		})
+		first <- err
+	}()
+	<-started
+
+	before := coalescedCount()
+	second := make(chan error, 1)
+	go func() {
+		_, err := g.do(context.Background(), "key", func() (CommandResult, error) {
+			t.Error("command ran again")
+			return CommandResult{}, nil
+		})
+		second <- err
+	}()
+	waitJoined(t, g, "key", 1)
+	close(release)
+
+	if err := <-first; err != failure {
+		t.Errorf("first call returned %v", err)
+	}
+	if err := <-second; err != failure {
+		t.Errorf("waiting call returned %v, want the shared failure", err)
+	}
+	if n := coalescedCount() - before; n != 1 {
+		t.Errorf("%g calls counted as coalesced, want 1", n)
+	}
+}
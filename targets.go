@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a target is rejected by the allowlist.
+const (
+	reasonTargetPort = "port"
+	reasonTargetHost = "host"
+)
+
+var targetRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "nrpe_exporter_target_rejections_total",
+	Help: "Number of export requests rejected because the target is not in the allowlist, by reason.",
+}, []string{"reason"})
+
+// TargetAllowlist restricts the NRPE servers the exporter connects to.
+type TargetAllowlist struct {
+	// Networks are CIDRs the target must resolve into, unless its host name
+	// matches Hosts.
+	Networks []string `yaml:"networks,omitempty"`
+	// Hosts are shell-style patterns of allowed host names, such as
+	// *.example.com.
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Ports are the allowed target ports, any port if empty. Likewise any
+	// host is allowed if neither Networks nor Hosts are set.
+	Ports []int `yaml:"ports,omitempty"`
+
+	networks []*net.IPNet
+}
+
+// targetRejectedError is returned for targets the allowlist doesn't allow.
+type targetRejectedError struct {
+	reason string
+	msg    string
+}
+
+func (e *targetRejectedError) Error() string {
+	return e.msg
+}
+
+// targetLookupError is returned when the host of a target can't be resolved
+// to check it against the allowed networks. It is not a rejection: the probe
+// fails as it would if resolving failed when connecting.
+type targetLookupError struct {
+	err error
+}
+
+func (e *targetLookupError) Error() string {
+	return "error resolving target: " + e.err.Error()
+}
+
+func (e *targetLookupError) Unwrap() error {
+	return e.err
+}
+
+// init validates the allowlist and parses its networks.
+func (a *TargetAllowlist) init() error {
+	for _, cidr := range a.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		a.networks = append(a.networks, network)
+	}
+	for _, pattern := range a.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q: %s", pattern, err)
+		}
+	}
+	for _, port := range a.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	return nil
+}
+
+// check returns the address to connect to for target, a
+// *targetRejectedError if the target isn't allowed, or a *targetLookupError
+// if its host can't be resolved. Targets allowed by their
+// network are resolved here and the returned address is the matching IP, so
+// the name can't resolve elsewhere by the time the exporter connects. The
+// time taken to resolve it is recorded in the dial trace of ctx.
+func (a *TargetAllowlist) check(ctx context.Context, target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+
+	if len(a.Ports) > 0 {
+		allowed := false
+		for _, p := range a.Ports {
+			allowed = allowed || strconv.Itoa(p) == port
+		}
+		if !allowed {
+			return "", &targetRejectedError{reasonTargetPort, fmt.Sprintf("port %s is not allowed", port)}
+		}
+	}
+
+	if len(a.Hosts) == 0 && len(a.networks) == 0 {
+		return target, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range a.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return target, nil
+		}
+	}
+
+	if len(a.networks) > 0 {
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			start := time.Now()
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			dialTraceFrom(ctx).dns = time.Since(start).Seconds()
+			if err != nil {
+				return "", &targetLookupError{err}
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+		for _, ip := range ips {
+			for _, network := range a.networks {
+				if network.Contains(ip) {
+					return net.JoinHostPort(ip.String(), port), nil
+				}
+			}
+		}
+	}
+	return "", &targetRejectedError{reasonTargetHost, fmt.Sprintf("host %s is not allowed", host)}
+}
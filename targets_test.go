@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTargetAllowlistCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		allowlist TargetAllowlist
+		target    string
+		address   string
+		// err is "" if allowed, the rejection reason, "lookup" or
+		// "invalid".
+		err string
+	}{
+		{
+			name:    "no restrictions",
+			target:  "anything.example.com:1234",
+			address: "anything.example.com:1234",
+		},
+		{
+			name:      "port allowed",
+			allowlist: TargetAllowlist{Ports: []int{5666, 5667}},
+			target:    "nrpe.example.com:5667",
+			address:   "nrpe.example.com:5667",
+		},
+		{
+			name:      "port rejected",
+			allowlist: TargetAllowlist{Ports: []int{5666}, Hosts: []string{"*"}},
+			target:    "nrpe.example.com:22",
+			err:       reasonTargetPort,
+		},
+		{
+			name:      "host glob with case and trailing dot",
+			allowlist: TargetAllowlist{Hosts: []string{"*.Nagios.example.com"}},
+			target:    "WEB1.nagios.example.com.:5666",
+			address:   "WEB1.nagios.example.com.:5666",
+		},
+		{
+			name:      "host glob mismatch",
+			allowlist: TargetAllowlist{Hosts: []string{"*.nagios.example.com"}},
+			target:    "nagios.example.com.evil.org:5666",
+			err:       reasonTargetHost,
+		},
+		{
+			name:      "name resolved into network",
+			allowlist: TargetAllowlist{Networks: []string{"127.0.0.0/8"}},
+			target:    "localhost:5666",
+			address:   "127.0.0.1:5666",
+		},
+		{
+			name:      "IP in network",
+			allowlist: TargetAllowlist{Networks: []string{"192.168.1.0/24", "10.0.0.0/8"}},
+			target:    "10.1.2.3:5666",
+			address:   "10.1.2.3:5666",
+		},
+		{
+			name:      "IPv6 in network",
+			allowlist: TargetAllowlist{Networks: []string{"fd00::/8"}},
+			target:    "[fd00::1]:5666",
+			address:   "[fd00::1]:5666",
+		},
+		{
+			name:      "IP outside networks",
+			allowlist: TargetAllowlist{Networks: []string{"10.0.0.0/8"}, Hosts: []string{"*.example.com"}},
+			target:    "192.168.1.1:5666",
+			err:       reasonTargetHost,
+		},
+		{
+			name:      "lookup failure",
+			allowlist: TargetAllowlist{Networks: []string{"10.0.0.0/8"}},
+			target:    "nonexistent.invalid:5666",
+			err:       "lookup",
+		},
+		{
+			name:      "no port",
+			allowlist: TargetAllowlist{Networks: []string{"10.0.0.0/8"}},
+			target:    "10.1.2.3",
+			err:       "invalid",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.allowlist.init(); err != nil {
+				t.Fatal(err)
+			}
+			trace := &dialTrace{}
+			address, err := tc.allowlist.check(withDialTrace(context.Background(), trace), tc.target)
+
+			var rejected *targetRejectedError
+			var lookup *targetLookupError
+			got := ""
+			switch {
+			case errors.As(err, &rejected):
+				got = rejected.reason
+			case errors.As(err, &lookup):
+				got = "lookup"
+			case err != nil:
+				got = "invalid"
+			}
+			if got != tc.err {
+				t.Fatalf("check(%q) returned %v, want %q", tc.target, err, tc.err)
+			}
+			if address != tc.address {
+				t.Errorf("check(%q) returned address %q, want %q", tc.target, address, tc.address)
+			}
+			if resolved := tc.address != "" && tc.address != tc.target; resolved && trace.dns == 0 {
+				t.Errorf("check(%q) didn't record the lookup", tc.target)
+			}
+		})
+	}
+}
+
+func targetRejectionCount() float64 {
+	var total float64
+	for _, reason := range []string{reasonTargetHost, reasonTargetPort} {
+		var m dto.Metric
+		targetRejections.WithLabelValues(reason).Write(&m)
+		total += m.GetCounter().GetValue()
+	}
+	return total
+}
+
+func TestExportTargetAllowlist(t *testing.T) {
+	allowlist := &TargetAllowlist{Networks: []string{"10.0.0.0/8"}}
+	if err := allowlist.init(); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{AllowedTargets: allowlist}
+
+	before := targetRejectionCount()
+	w := export(t, config, "target=192.168.1.1:5666&command=check_load", nil)
+	if w.Code != 403 {
+		t.Errorf("disallowed target returned %d, want 403", w.Code)
+	}
+	if targetRejectionCount() != before+1 {
+		t.Error("disallowed target wasn't counted as a rejection")
+	}
+
+	// A name that can't be resolved isn't rejected, its probe fails.
+	before = targetRejectionCount()
+	w = export(t, config, "target=nonexistent.invalid:5666&command=check_load", nil)
+	if w.Code != 200 {
+		t.Fatalf("unresolvable target returned %d, want 200: %s", w.Code, w.Body)
+	}
+	for _, line := range []string{
+		`nrpe_probe_failure_reason{command="check_load",reason="dns"} 1`,
+		"nrpe_up 0",
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("unresolvable target didn't report %s", line)
+		}
+	}
+	if targetRejectionCount() != before {
+		t.Error("unresolvable target was counted as a rejection")
+	}
+}
+
+// stubResolver makes name lookups fail after delay, or once their context
+// is done, until the test ends.
+func stubResolver(t *testing.T, delay time.Duration) {
+	resolver := net.DefaultResolver
+	t.Cleanup(func() { net.DefaultResolver = resolver })
+	deadline := time.Now().Add(delay)
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			select {
+			case <-time.After(time.Until(deadline)):
+				return nil, errors.New("name server unreachable")
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	}
+}
+
+// phaseDuration returns the duration of phase in an /export response.
+func phaseDuration(t *testing.T, body, command, phase string) float64 {
+	t.Helper()
+	prefix := fmt.Sprintf("nrpe_phase_duration_seconds{command=%q,phase=%q} ", command, phase)
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			v, err := strconv.ParseFloat(line[len(prefix):], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("response has no %s phase", phase)
+	return 0
+}
+
+// TestExportTargetLookup checks that the scrape timeout covers resolving
+// the target, and that resolving it is reported as the dns phase.
+func TestExportTargetLookup(t *testing.T) {
+	allowlist := &TargetAllowlist{Networks: []string{"10.0.0.0/8", "127.0.0.0/8"}}
+	if err := allowlist.init(); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{AllowedTargets: allowlist}
+
+	// Nothing listens on port 1 of the address localhost resolves to.
+	w := export(t, config, "target=localhost:1&command=check_load", nil)
+	if line := `nrpe_probe_failure_reason{command="check_load",reason="connect_refused"} 1`; !strings.Contains(w.Body.String(), line+"\n") {
+		t.Fatalf("scrape didn't report %s: %s", line, w.Body)
+	}
+	if dns := phaseDuration(t, w.Body.String(), "check_load", phaseDNS); dns == 0 {
+		t.Error("dns phase doesn't include resolving the target")
+	}
+
+	query := "target=nrpe.example.com:5666&command=check_load"
+	// A name server that answers slowly.
+	stubResolver(t, 200*time.Millisecond)
+	w = export(t, config, query, nil)
+	if w.Code != 200 {
+		t.Fatalf("scrape returned %d: %s", w.Code, w.Body)
+	}
+	if line := `nrpe_probe_failure_reason{command="check_load",reason="dns"} 1`; !strings.Contains(w.Body.String(), line+"\n") {
+		t.Errorf("scrape didn't report %s", line)
+	}
+	if dns := phaseDuration(t, w.Body.String(), "check_load", phaseDNS); dns < 0.2 || dns > 1 {
+		t.Errorf("dns phase took %gs, want the 0.2s lookup", dns)
+	}
+
+	// A name server that never answers.
+	stubResolver(t, time.Hour)
+	start := time.Now()
+	header := http.Header{"X-Prometheus-Scrape-Timeout-Seconds": {"1"}}
+	w = export(t, config, query, header)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("scrape took %s with a 1s timeout", elapsed)
+	}
+	if w.Code != 200 {
+		t.Fatalf("scrape returned %d: %s", w.Code, w.Body)
+	}
+	if line := `nrpe_probe_failure_reason{command="check_load",reason="timeout"} 1`; !strings.Contains(w.Body.String(), line+"\n") {
+		t.Errorf("scrape didn't report %s", line)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/canonical/nrpe_exporter/adh"
+)
+
+// SSL modes of NRPE connections.
+const (
+	// tlsModeADH is TLS with anonymous Diffie-Hellman, what NRPE speaks
+	// when SSL is enabled without certificates.
+	tlsModeADH = "adh"
+	// tlsModeVerify is TLS with the server certificate checked against a
+	// CA, and optionally a client certificate, for NRPE 3+ set up with
+	// ssl_cacert_file and ssl_client_certs.
+	tlsModeVerify = "verify"
+	// tlsModeInsecure is TLS without verifying the server certificate, for
+	// daemons with certificates but without ADH (ssl_use_adh=0) where no CA
+	// is at hand.
+	tlsModeInsecure = "insecure"
+)
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// TLSConfig configures SSL connections to NRPE servers.
+type TLSConfig struct {
+	// Mode is adh (the default), verify or insecure.
+	Mode       string   `yaml:"mode,omitempty"`
+	CAFile     string   `yaml:"ca_file,omitempty"`
+	CertFile   string   `yaml:"cert_file,omitempty"`
+	KeyFile    string   `yaml:"key_file,omitempty"`
+	ServerName string   `yaml:"server_name,omitempty"`
+	MinVersion string   `yaml:"min_version,omitempty"`
+	Ciphers    []string `yaml:"ciphers,omitempty"`
+}
+
+// tlsTransport connects over TLS with crypto/tls, verifying the server
+// certificate unless the mode is insecure.
+type tlsTransport struct {
+	mode   string
+	config *tls.Config
+}
+
+func (t tlsTransport) Dial(ctx context.Context, address, serverName string) (net.Conn, *tlsState, error) {
+	raw, err := dialTCP(ctx, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := t.config
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = serverName
+	}
+	conn := tls.Client(raw, config)
+	start := time.Now()
+	err = conn.HandshakeContext(ctx)
+	dialTraceFrom(ctx).tls = time.Since(start).Seconds()
+	if err != nil {
+		raw.Close()
+		return nil, nil, &handshakeError{err}
+	}
+	state := conn.ConnectionState()
+	return conn, &tlsState{
+		mode:              t.mode,
+		version:           tlsVersionName(state.Version),
+		cipher:            tls.CipherSuiteName(state.CipherSuite),
+		handshakeDuration: time.Since(start).Seconds(),
+		certExpiry:        state.PeerCertificates[0].NotAfter,
+	}, nil
+}
+
+func tlsVersionName(version uint16) string {
+	if version == tls.VersionTLS13 {
+		return "TLS 1.3"
+	}
+	return adh.VersionName(version)
+}
+
+// transport returns the transport for the configured mode.
+func (c TLSConfig) transport() (transport, error) {
+	var minVersion uint16
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", c.MinVersion)
+		}
+		minVersion = v
+	}
+
+	switch c.Mode {
+	case "", tlsModeADH:
+		if c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" {
+			return nil, fmt.Errorf("certificate settings require mode %q", tlsModeVerify)
+		}
+		if minVersion > adh.VersionTLS12 {
+			return nil, fmt.Errorf("anonymous DH is not available with %s", c.MinVersion)
+		}
+		config := &adh.Config{MinVersion: minVersion}
+		for _, name := range c.Ciphers {
+			id, ok := adh.CipherSuiteByName(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown anonymous DH cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+		return adhTransport{config}, nil
+	case tlsModeVerify, tlsModeInsecure:
+		config := &tls.Config{
+			ServerName: c.ServerName,
+			MinVersion: minVersion,
+		}
+		if c.Mode == tlsModeInsecure {
+			if c.CAFile != "" || c.ServerName != "" {
+				return nil, fmt.Errorf("CA file and server name require mode %q", tlsModeVerify)
+			}
+			config.InsecureSkipVerify = true
+		}
+		if c.CAFile != "" {
+			pem, err := ioutil.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load CA file: %s", err)
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA file %q", c.CAFile)
+			}
+		}
+		if (c.CertFile == "") != (c.KeyFile == "") {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		if c.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load client certificate: %s", err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		for _, name := range c.Ciphers {
+			id, ok := tlsCipherSuiteByName(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+		return tlsTransport{c.Mode, config}, nil
+	}
+	return nil, fmt.Errorf("unknown SSL mode %q", c.Mode)
+}
+
+// tlsCipherSuiteByName looks up a crypto/tls cipher suite by its standard name.
+func tlsCipherSuiteByName(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range suites {
+			if s.Name == name {
+				return s.ID, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/canonical/nrpe_exporter/adh"
+)
+
+// transport opens connections to NRPE servers.
+type transport interface {
+	// Dial connects to address. For TLS connections it also returns the
+	// details of the session, and serverName is the target host name to
+	// verify certificates against. The deadline of ctx applies to connecting,
+	// the handshake and all later I/O on the connection, and cancelling ctx
+	// aborts connecting and the handshake.
+	Dial(ctx context.Context, address, serverName string) (net.Conn, *tlsState, error)
+}
+
+// tlsState describes the TLS session of a connection.
+type tlsState struct {
+	mode              string
+	version           string
+	cipher            string
+	handshakeDuration float64
+	// certExpiry is the notAfter of the server certificate, zero without
+	// certificates.
+	certExpiry time.Time
+}
+
+// handshakeError is returned by transports when the TLS handshake fails.
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string {
+	return "TLS handshake failed: " + e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// plainTransport connects over unencrypted TCP, for daemons started with -n.
+type plainTransport struct{}
+
+func (plainTransport) Dial(ctx context.Context, address, serverName string) (net.Conn, *tlsState, error) {
+	conn, err := dialTCP(ctx, address)
+	return conn, nil, err
+}
+
+// dialTrace records how long the phases of dialing took, in seconds.
+type dialTrace struct {
+	dns     float64
+	connect float64
+	tls     float64
+}
+
+// record adds the phase durations to phases.
+func (t *dialTrace) record(phases map[string]float64) {
+	phases[phaseDNS] = t.dns
+	phases[phaseConnect] = t.connect
+	phases[phaseTLS] = t.tls
+}
+
+type dialTraceKey struct{}
+
+// withDialTrace returns a context that makes transports record their phase
+// durations in t.
+func withDialTrace(ctx context.Context, t *dialTrace) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, t)
+}
+
+// dialTraceFrom returns the trace of ctx, or one that is discarded.
+func dialTraceFrom(ctx context.Context) *dialTrace {
+	if t, ok := ctx.Value(dialTraceKey{}).(*dialTrace); ok {
+		return t
+	}
+	return &dialTrace{}
+}
+
+// dialTCP connects to address, setting the deadline of ctx on the
+// connection. It resolves the host itself to time name resolution apart from
+// connecting, trying each address in turn.
+func dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	trace := dialTraceFrom(ctx)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		start := time.Now()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		trace.dns = time.Since(start).Seconds()
+		if err != nil {
+			return nil, err
+		}
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.String())
+		}
+	}
+
+	var d net.Dialer
+	var conn net.Conn
+	start := time.Now()
+	for _, ip := range ips {
+		conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	trace.connect = time.Since(start).Seconds()
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// interruptOnCancel makes pending and later I/O on conn fail once ctx is
+// cancelled, until the returned function is called.
+func interruptOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// adhTransport connects over TLS with anonymous Diffie-Hellman key exchange,
+// which is what NRPE daemons speak when SSL is enabled without certificates.
+type adhTransport struct {
+	config *adh.Config
+}
+
+func (t adhTransport) Dial(ctx context.Context, address, serverName string) (net.Conn, *tlsState, error) {
+	raw, err := dialTCP(ctx, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn := adh.Client(raw, t.config)
+	start := time.Now()
+	stop := interruptOnCancel(ctx, raw)
+	err = conn.Handshake()
+	stop()
+	dialTraceFrom(ctx).tls = time.Since(start).Seconds()
+	if err != nil {
+		raw.Close()
+		return nil, nil, &handshakeError{err}
+	}
+	state := conn.ConnectionState()
+	return conn, &tlsState{
+		mode:              tlsModeADH,
+		version:           adh.VersionName(state.Version),
+		cipher:            adh.CipherSuiteName(state.CipherSuite),
+		handshakeDuration: time.Since(start).Seconds(),
+	}, nil
+}
+
+// fallbackTransport is the transport of ssl=true. It speaks ADH, and falls
+// back to TLS without verification for daemons with certificates but without
+// ADH, which OpenSSL's ALL cipher list used to reach as well. Such daemons
+// either refuse the ADH suites or send their certificate anyway.
+type fallbackTransport struct {
+	adh      adhTransport
+	insecure transport
+}
+
+func (t fallbackTransport) Dial(ctx context.Context, address, serverName string) (net.Conn, *tlsState, error) {
+	conn, state, err := t.adh.Dial(ctx, address, serverName)
+	if !errors.Is(err, adh.ErrServerCertificate) && !errors.Is(err, adh.ErrHandshakeFailure) {
+		return conn, state, err
+	}
+	// Redial, counting the time of both attempts.
+	trace := dialTraceFrom(ctx)
+	first := *trace
+	conn, state, err = t.insecure.Dial(ctx, address, serverName)
+	trace.dns += first.dns
+	trace.connect += first.connect
+	trace.tls += first.tls
+	return conn, state, err
+}
+
+// sslTransports returns the transports selected by the values of the ssl
+// query parameter. config holds the settings of ssl=verify, of which the
+// client certificate, minimum version and ciphers apply to ssl=insecure too,
+// and so to ssl=true when it falls back to it. ADH has no settings.
+func sslTransports(config TLSConfig) (map[string]transport, error) {
+	verify := config
+	verify.Mode = tlsModeVerify
+	verifyTransport, err := verify.transport()
+	if err != nil {
+		return nil, err
+	}
+	insecure := TLSConfig{
+		Mode:       tlsModeInsecure,
+		CertFile:   config.CertFile,
+		KeyFile:    config.KeyFile,
+		MinVersion: config.MinVersion,
+		Ciphers:    config.Ciphers,
+	}
+	insecureTransport, err := insecure.transport()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]transport{
+		"":              plainTransport{},
+		"false":         plainTransport{},
+		"true":          fallbackTransport{adhTransport{}, insecureTransport},
+		tlsModeADH:      adhTransport{},
+		tlsModeVerify:   verifyTransport,
+		tlsModeInsecure: insecureTransport,
+	}, nil
+}